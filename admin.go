@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+)
+
+/* Admin API is a simple HTTP server listening on a unix socket.
+ * It is used by the command line client (see cmd.go) to query
+ * and control the running plugin.
+ *
+ * All the replies are JSON. In case of an error, HTTP status
+ * is not 200, and the reply is adminError. Requests changing
+ * anything are only accepted as POST.
+ */
+
+// adminError is an admin API error reply
+type adminError struct {
+	Err string
+}
+
+// adminFunc handles an admin API request, returning a reply
+// to be JSON-encoded, or an error
+type adminFunc func(r *http.Request) (interface{}, error)
+
+func adminHandler(fn adminFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reply, err := fn(r)
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			logrus.Errorf("Admin API %s: %s", r.URL.Path, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			reply = adminError{Err: err.Error()}
+		}
+		json.NewEncoder(w).Encode(reply)
+	}
+}
+
+// adminPostHandler is like adminHandler, but for requests changing
+// something, which are only accepted as POST
+func adminPostHandler(fn adminFunc) http.HandlerFunc {
+	h := adminHandler(fn)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(adminError{Err: fmt.Sprintf("Method %s not allowed, use POST", r.Method)})
+			return
+		}
+		h(w, r)
+	}
+}
+
+// adminMux returns admin API request multiplexer
+func (d *ploopDriver) adminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", expvar.Handler())
+	mux.Handle("/ops", adminHandler(d.adminOps))
+	mux.Handle("/drain", adminPostHandler(d.adminDrain))
+	mux.Handle("/release", adminPostHandler(d.adminRelease))
+	mux.Handle("/doctor", adminHandler(d.adminDoctor))
+	mux.Handle("/check", adminPostHandler(d.adminCheck))
+	mux.Handle("/broken", adminHandler(d.adminBroken))
+	mux.Handle("/quarantine", adminPostHandler(d.adminQuarantine))
+	mux.Handle("/gc", adminPostHandler(d.adminGC))
+	mux.Handle("/compact", adminPostHandler(d.adminCompact))
+	mux.Handle("/shrink", adminPostHandler(d.adminShrink))
+	mux.Handle("/convert", adminPostHandler(d.adminConvert))
+	mux.Handle("/relayout", adminPostHandler(d.adminRelayout))
+	mux.Handle("/rename", adminPostHandler(d.adminRename))
+	mux.Handle("/quota", adminHandler(d.adminQuota))
+	mux.Handle("/set-quota", adminPostHandler(d.adminSetQuota))
+	mux.Handle("/set-owner", adminPostHandler(d.adminSetOwner))
+	mux.Handle("/rotate-key", adminPostHandler(d.adminRotateKey))
+
+	return mux
+}
+
+// listenUnix listens on a unix socket only accessible by root
+func listenUnix(sock string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(sock), 0700); err != nil {
+		return nil, err
+	}
+	// remove a stale socket, if any
+	if err := os.Remove(sock); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(sock, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// unixTransport is an HTTP transport connecting to a unix socket
+func unixTransport(sock string) *http.Transport {
+	return &http.Transport{
+		Dial: func(_, _ string) (net.Conn, error) {
+			return net.Dial("unix", sock)
+		},
+	}
+}
+
+// serveAdmin starts serving the admin API on the unix socket sock
+func (d *ploopDriver) serveAdmin(sock string) error {
+	l, err := listenUnix(sock)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		err := http.Serve(l, d.adminMux())
+		logrus.Errorf("Admin API server exited: %s", err)
+	}()
+
+	return nil
+}
+
+// adminCall makes an admin API request to the running plugin.
+// If in is not nil, it is sent JSON-encoded as a request body.
+// The reply is decoded into out.
+func adminCall(method, path string, in, out interface{}) error {
+	c := http.Client{Transport: unixTransport(*adminSock)}
+
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, "http://plugin"+path, body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return fmt.Errorf("Can't connect to the plugin: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e adminError
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+			return fmt.Errorf("Admin API error: %s", resp.Status)
+		}
+		return fmt.Errorf("%s", e.Err)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
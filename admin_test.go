@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminMethods(t *testing.T) {
+	d := &ploopDriver{}
+	mux := d.adminMux()
+
+	tests := []struct {
+		method, url string
+		code        int
+	}{
+		{"GET", "/drain", http.StatusMethodNotAllowed},
+		{"PUT", "/drain", http.StatusMethodNotAllowed},
+		{"GET", "/gc", http.StatusMethodNotAllowed},
+		{"GET", "/rename?volume=a&name=b", http.StatusMethodNotAllowed},
+		{"GET", "/set-quota", http.StatusMethodNotAllowed},
+		{"GET", "/relayout", http.StatusMethodNotAllowed},
+		{"GET", "/ops", http.StatusOK},
+		{"POST", "/drain?mode=off", http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		req := httptest.NewRequest(tc.method, tc.url, nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != tc.code {
+			t.Errorf("%s %s: %d, expected %d", tc.method, tc.url, w.Code, tc.code)
+		}
+	}
+	if d.draining {
+		t.Error("drain mode is enabled by a rejected request")
+	}
+
+	req := httptest.NewRequest("GET", "/drain?mode=on", nil)
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+	if d.draining {
+		t.Error("drain mode is enabled by GET")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Operations that change the state of volumes, and are therefore audited
+var mutatingOps = map[string]bool{
+	"create":     true,
+	"remove":     true,
+	"mount":      true,
+	"unmount":    true,
+	"repair":     true,
+	"quarantine": true,
+	"gc":         true,
+	"compact":    true,
+	"shrink":     true,
+	"convert":    true,
+	"relayout":   true,
+	"set-quota":  true,
+	"set-owner":  true,
+	"rotate-key": true,
+	"erase":      true,
+	"rename":     true,
+	"release":    true,
+}
+
+func isMutating(name string) bool {
+	return mutatingOps[name]
+}
+
+// auditRecord is a single audit log entry, written as a line of JSON
+type auditRecord struct {
+	Time     time.Time         `json:"time"`
+	Op       string            `json:"op"`
+	Volume   string            `json:"volume,omitempty"`
+	MountID  string            `json:"mount_id,omitempty"`
+	Options  map[string]string `json:"options,omitempty"`
+	Result   string            `json:"result"`
+	Error    string            `json:"error,omitempty"`
+	PloopErr string            `json:"ploop_error,omitempty"`
+	Duration string            `json:"duration"`
+}
+
+// auditLog is an append-only log of mutating operations,
+// rotated once it grows beyond maxSize bytes.
+type auditLog struct {
+	sync.Mutex
+	file    string
+	maxSize int64 // rotate after this size (0: never)
+	keep    int   // number of rotated files to keep
+	f       *os.File
+	size    int64
+}
+
+// audit is the global audit log; nil if auditing is disabled
+var audit *auditLog
+
+func newAuditLog(file string, maxSize int64, keep int) (*auditLog, error) {
+	a := auditLog{
+		file:    file,
+		maxSize: maxSize,
+		keep:    keep,
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	a.f = f
+	a.size = fi.Size()
+	return nil
+}
+
+// rotate renames file to file.1, file.1 to file.2 and so on,
+// removing the oldest one, and opens a new file.
+func (a *auditLog) rotate() error {
+	a.f.Close()
+	a.f = nil
+
+	if a.keep < 1 {
+		os.Remove(a.file)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", a.file, a.keep))
+		for i := a.keep - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", a.file, i), fmt.Sprintf("%s.%d", a.file, i+1))
+		}
+		if err := os.Rename(a.file, a.file+".1"); err != nil {
+			return err
+		}
+	}
+
+	return a.open()
+}
+
+func (a *auditLog) write(r *auditRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	a.Lock()
+	defer a.Unlock()
+
+	if a.f == nil {
+		// previous rotation failed, try again
+		if err := a.open(); err != nil {
+			return err
+		}
+	}
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(b)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := a.f.Write(b)
+	a.size += int64(n)
+	return err
+}
+
+// record adds an operation outcome to the audit log
+func (a *auditLog) record(o *op, opts map[string]string, dur time.Duration, err error) {
+	if a == nil {
+		return
+	}
+
+	r := auditRecord{
+		Time:     o.start,
+		Op:       o.name,
+		Volume:   o.vol,
+		MountID:  o.id,
+		Options:  opts,
+		Result:   "ok",
+		Duration: dur.String(),
+	}
+	if err != nil {
+		r.Result = "error"
+		r.Error = err.Error()
+		r.PloopErr = ploopErrCode(err)
+	}
+
+	if err := a.write(&r); err != nil {
+		logrus.Errorf("Can't write to audit log %s: %s", a.file, err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// countLines returns the number of lines in a file, or -1 if there's none
+func countLines(t *testing.T, file string) int {
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return -1
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bytes.Count(b, []byte("\n"))
+}
+
+func TestAuditRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := auditRecord{Op: "create", Volume: "vol", Result: "ok", Duration: "1s"}
+	b, err := json.Marshal(&r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(b) + 1)
+
+	tests := []struct {
+		name    string
+		maxSize int64
+		keep    int
+		writes  int
+		lines   []int // in file, file.1, file.2 and so on; -1: no file
+	}{
+		{name: "no rotation", maxSize: 0, keep: 2, writes: 5, lines: []int{5, -1}},
+		{name: "below threshold", maxSize: 5 * size, keep: 2, writes: 5, lines: []int{5, -1}},
+		{name: "at threshold", maxSize: 2 * size, keep: 2, writes: 3, lines: []int{1, 2, -1}},
+		{name: "keep 2", maxSize: 2 * size, keep: 2, writes: 7, lines: []int{1, 2, 2, -1}},
+		{name: "keep 1", maxSize: 2 * size, keep: 1, writes: 7, lines: []int{1, 2, -1}},
+		{name: "keep none", maxSize: 2 * size, keep: 0, writes: 7, lines: []int{1, -1}},
+		// a record never goes to a file alone
+		{name: "record bigger than max size", maxSize: size / 2, keep: 3, writes: 3, lines: []int{1, 1, 1, -1}},
+	}
+
+	for n, tc := range tests {
+		file := path.Join(dir, fmt.Sprintf("audit%d.log", n))
+		a, err := newAuditLog(file, tc.maxSize, tc.keep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < tc.writes; i++ {
+			if err := a.write(&r); err != nil {
+				t.Errorf("%s: write %d: %s", tc.name, i, err)
+			}
+		}
+		a.f.Close()
+
+		for i, lines := range tc.lines {
+			f := file
+			if i > 0 {
+				f = fmt.Sprintf("%s.%d", file, i)
+			}
+			if got := countLines(t, f); got != lines {
+				t.Errorf("%s: %s has %d line(s), expected %d", tc.name, path.Base(f), got, lines)
+			}
+		}
+	}
+}
+
+func TestAuditReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the size of an existing log counts, too
+	file := path.Join(dir, "audit.log")
+	if err := ioutil.WriteFile(file, bytes.Repeat([]byte("x\n"), 50), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := newAuditLog(file, 100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.f.Close()
+	if err := a.write(&auditRecord{Op: "gc"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := countLines(t, file+".1"); got != 50 {
+		t.Errorf("rotated file has %d line(s), expected 50", got)
+	}
+	if got := countLines(t, file); got != 1 {
+		t.Errorf("file has %d line(s), expected 1", got)
+	}
+}
+
+func TestMutatingOps(t *testing.T) {
+	for _, name := range []string{"create", "remove", "mount", "unmount", "repair", "quarantine",
+		"gc", "compact", "shrink", "convert", "relayout", "set-quota", "set-owner",
+		"rotate-key", "erase", "rename", "release"} {
+		if !isMutating(name) {
+			t.Errorf("%s is not audited", name)
+		}
+	}
+	for _, name := range []string{"get", "list", "path", "quota", "check", "gc-dry-run", "shrink-dry-run"} {
+		if isMutating(name) {
+			t.Errorf("%s is audited", name)
+		}
+	}
+}
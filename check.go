@@ -0,0 +1,232 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/kolyshkin/docker-volume-ploop/diskdescriptor"
+	"github.com/kolyshkin/goploop"
+)
+
+// Possible fsck policies on mount
+const (
+	fsckAlways = "always" // on every mount
+	fsckAuto   = "auto"   // if the volume was not cleanly unmounted
+	fsckNever  = "never"
+)
+
+// Possible check step outcomes
+const (
+	stepOK      = "ok"
+	stepFailed  = "failed"
+	stepSkipped = "skipped"
+)
+
+// checkStep is an outcome of a single volume check step
+type checkStep struct {
+	Name    string
+	Status  string
+	Message string `json:",omitempty"`
+}
+
+// checkResult is an outcome of a volume check
+type checkResult struct {
+	Volume  string
+	OK      bool
+	Mounted bool
+	Steps   []checkStep
+}
+
+func (c *checkResult) step(name, status, msg string) {
+	c.Steps = append(c.Steps, checkStep{Name: name, Status: status, Message: msg})
+	if status == stepFailed {
+		c.OK = false
+	}
+}
+
+// check checks volume consistency: DiskDescriptor.xml, delta files,
+// ploop image and (optionally) its inner filesystem. If repair is set,
+// problems found are fixed, if possible.
+func (d *ploopDriver) check(o *op, name string, fsck, repair bool) *checkResult {
+	c := checkResult{Volume: name, OK: true}
+	dd := d.dd(name)
+
+	desc, err := diskdescriptor.Read(dd)
+	if err != nil {
+		c.step("descriptor", stepFailed, err.Error())
+		return &c
+	}
+	c.step("descriptor", stepOK, fmt.Sprintf("%d image(s)", len(desc.Images)))
+
+	var missing []string
+	for _, f := range desc.Files() {
+		if _, err := os.Stat(f); err != nil {
+			missing = append(missing, err.Error())
+		}
+	}
+	if len(missing) > 0 {
+		c.step("deltas", stepFailed, strings.Join(missing, "; "))
+		return &c
+	}
+	c.step("deltas", stepOK, "")
+
+	p, err := ploop.Open(dd)
+	if err != nil {
+		c.step("open", stepFailed, err.Error())
+		return &c
+	}
+	defer p.Close()
+	c.Mounted, _ = p.IsMounted()
+
+	if c.Mounted {
+		c.step("image", stepSkipped, "volume is mounted")
+	} else {
+		args := []string{"check"}
+		if repair {
+			args = append(args, "-F")
+		}
+		o.log.Debugf("Checking image")
+		out, err := ploopCmdOut(append(args, dd)...)
+		if err != nil {
+			c.step("image", stepFailed, err.Error())
+			return &c
+		}
+		c.step("image", stepOK, strings.TrimSpace(out))
+	}
+
+	if !fsck {
+		return &c
+	}
+	if c.Mounted {
+		c.step("fsck", stepSkipped, "volume is mounted")
+		return &c
+	}
+
+	o.log.Debugf("Checking inner filesystem")
+	mnt := d.mnt(name)
+	if err := os.Mkdir(mnt, 0700); err != nil && !os.IsExist(err) {
+		c.step("fsck", stepFailed, err.Error())
+		return &c
+	}
+	meta, err := d.loadMeta(name)
+	if err != nil {
+		c.step("fsck", stepFailed, err.Error())
+		return &c
+	}
+	if _, err := d.mountFS(o, p, name, meta, &ploop.MountParam{Target: mnt, Fsck: true}); err != nil {
+		c.step("fsck", stepFailed, err.Error())
+		return &c
+	}
+	if err := d.umountFS(o, p, name, meta); err != nil {
+		c.step("fsck", stepFailed, fmt.Sprintf("Can't unmount: %s", err))
+		return &c
+	}
+	os.Remove(d.dirtyMark(name))
+	c.step("fsck", stepOK, "")
+
+	return &c
+}
+
+// needFsck decides whether to check the inner filesystem of the volume
+// on mount, according to its fsck policy
+func (d *ploopDriver) needFsck(name string, m *volumeMeta) bool {
+	policy := m.Fsck
+	if policy == "" {
+		policy = d.opts.fsck
+	}
+
+	switch policy {
+	case fsckAlways:
+		return true
+	case fsckNever:
+		return false
+	}
+
+	// auto: only if the volume was not cleanly unmounted
+	_, err := os.Stat(d.dirtyMark(name))
+	return err == nil
+}
+
+// adminCheck checks a volume, or all volumes if none is specified
+func (d *ploopDriver) adminCheck(r *http.Request) (interface{}, error) {
+	fsck := r.FormValue("fsck") != ""
+	repair := r.FormValue("repair") != ""
+
+	names := []string{r.FormValue("volume")}
+	if names[0] == "" {
+		vols, err := d.list()
+		if err != nil {
+			return nil, err
+		}
+		names = names[:0]
+		for _, v := range vols {
+			names = append(names, v.Name)
+		}
+	} else if err := d.findVol(names[0]); err != nil {
+		return nil, err
+	}
+
+	opName := "check"
+	if repair {
+		opName = "repair"
+	}
+	results := make([]*checkResult, 0, len(names))
+	for _, name := range names {
+		var c *checkResult
+		o := newOp(opName, name)
+		err := d.runAdmin(o, func() error {
+			c = d.check(o, name, fsck, repair)
+			if !c.OK {
+				return fmt.Errorf("Volume check failed")
+			}
+			return nil
+		})
+		if c == nil {
+			// not even started
+			return nil, err
+		}
+		results = append(results, c)
+	}
+
+	return results, nil
+}
+
+func cmdCheck(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	fsck := fs.Bool("fsck", false, "Check inner filesystem, too")
+	repair := fs.Bool("repair", false, "Try to fix the problems found")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		return fmt.Errorf("Usage: check [-fsck] [-repair] [VOLUME]")
+	}
+
+	q := url.Values{}
+	if fs.NArg() == 1 {
+		q.Set("volume", fs.Arg(0))
+	}
+	if *fsck {
+		q.Set("fsck", "1")
+	}
+	if *repair {
+		q.Set("repair", "1")
+	}
+
+	var results []checkResult
+	if err := adminCall("POST", "/check?"+q.Encode(), nil, &results); err != nil {
+		return err
+	}
+	if err := printJSON(results); err != nil {
+		return err
+	}
+	for _, c := range results {
+		if !c.OK {
+			return fmt.Errorf("Problems found")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// command is a command line client command
+type command struct {
+	fn    func(args []string) error
+	usage string // arguments
+	help  string // short description
+}
+
+// Commands that can be given on the command line
+var commands = map[string]command{
+	"broken":        {cmdBroken, "", "List broken volumes, with reasons"},
+	"check":         {cmdCheck, "[-fsck] [-repair] [VOLUME]", "Check (and repair) a volume, or all volumes"},
+	"compact":       {cmdCompact, "VOLUME", "Release image space not used by the volume filesystem"},
+	"convert":       {cmdConvert, "VOLUME MODE", "Convert a volume image to another mode (expanded, preallocated or raw)"},
+	"doctor":        {cmdDoctor, "[-plugin]", "Check the system for problems (from within the running plugin if -plugin is given)"},
+	"drain":         {cmdDrain, "[on|off]", "Reject (or accept again) new creates and mounts"},
+	"gc":            {cmdGC, "[-dry-run]", "Find and remove orphaned mount points, deltas, temp files and devices"},
+	"inspect-image": {cmdInspectImage, "VOLUME|DD|DELTA", "Show image delta(s) details, read directly from files"},
+	"key-server":    {cmdKeyServer, "[-socket SOCK] DIR", "Serve encryption keys from a directory, for unix: key provider"},
+	"metrics":       {cmdMetrics, "", "Show plugin metrics"},
+	"ops":           {cmdOps, "", "Show operations in progress"},
+	"quarantine":    {cmdQuarantine, "VOLUME", "Move a broken volume out of the way, for investigation"},
+	"quota":         {cmdQuota, "[-user|-group] VOLUME", "Show user and group quotas of a mounted volume"},
+	"release":       {cmdRelease, "VOLUME", "Unmount a volume adopted with unknown users, once they are gone"},
+	"relayout":      {cmdRelayout, "VOLUME CLOG", "Change cluster block size of an unmounted volume"},
+	"rename":        {cmdRename, "VOLUME NEW-NAME", "Rename an unmounted volume"},
+	"rotate-key":    {cmdRotateKey, "VOLUME", "Replace a volume encryption key with a new one"},
+	"set-owner":     {cmdSetOwner, "[-uid UID] [-gid GID] [-mode MODE] [-userns-remap USER] VOLUME", "Change owner and permissions of a volume root directory"},
+	"set-quota":     {cmdSetQuota, "[-group] VOLUME ID BLOCK-SOFT BLOCK-HARD INODE-SOFT INODE-HARD", "Set quota limits of a user (or a group) on a mounted volume"},
+	"shrink":        {cmdShrink, "[-dry-run] VOLUME [SIZE]", "Shrink an unmounted volume (or show how much it can be shrunk)"},
+}
+
+func commandsUsage() {
+	names := make([]string, 0, len(commands))
+	for n := range commands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	fmt.Printf("\nCommands (most of them talk to the running plugin via -admin socket):\n")
+	for _, n := range names {
+		c := commands[n]
+		fmt.Printf("  %s %s\n    \t%s\n", n, c.usage, c.help)
+	}
+}
+
+// runCommand runs a command line client command, and exits
+func runCommand(args []string) {
+	c, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", args[0])
+		usage(1)
+	}
+
+	if err := c.fn(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// printJSON prints v as indented JSON
+func printJSON(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", b)
+	return nil
+}
+
+func cmdMetrics(args []string) error {
+	var m map[string]interface{}
+	if err := adminCall("GET", "/metrics", nil, &m); err != nil {
+		return err
+	}
+
+	return printJSON(m["ploop"])
+}
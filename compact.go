@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-units"
+	"github.com/kolyshkin/docker-volume-ploop/diskdescriptor"
+)
+
+// How often to check if any volumes are due for compaction
+const compactCheck = 10 * time.Minute
+
+// How often to update compaction progress
+const compactProgress = 5 * time.Second
+
+// compactResult is an outcome of volume compaction
+type compactResult struct {
+	Volume    string
+	Before    int64 // space used by image files, in bytes
+	After     int64
+	Reclaimed int64
+	Duration  string
+}
+
+// filesUsage returns the disk space used by files
+func filesUsage(files []string) int64 {
+	var total int64
+	for _, f := range files {
+		var st syscall.Stat_t
+		if err := syscall.Stat(f, &st); err == nil {
+			total += st.Blocks * 512
+		}
+	}
+
+	return total
+}
+
+// compact releases image space not used by the inner filesystem.
+// Free filesystem blocks are discarded, the image data is relocated
+// to fill the holes, and the image file is truncated.
+//
+// The volume is only locked while checking it. A mounted volume is
+// compacted online, with no lock held, as that might take hours,
+// and Docker should be able to use the volume meanwhile. An unmounted
+// one is mounted by ploop for the time of compaction, so it is kept
+// locked until it's done.
+func (d *ploopDriver) compact(o *op, name string) (*compactResult, error) {
+	unlock := d.lockVol(o)
+	desc, err := d.compactCheck(o, name)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	online := d.isMounted(name)
+	if online {
+		o.log.Debugf("Volume is mounted, compacting online")
+		unlock()
+	} else {
+		defer unlock()
+	}
+	files := desc.Files()
+
+	defer d.heavyOp(o)()
+	// Remember when it was tried, for scheduled compaction
+	// not to retry too often in case it fails
+	defer func() {
+		if online {
+			defer d.lockVol(o)()
+		}
+		d.compactDone(o, name)
+	}()
+
+	start := time.Now()
+	r := compactResult{Volume: name, Before: filesUsage(files)}
+	o.log.Infof("Compacting volume")
+
+	stop := make(chan struct{})
+	go func() {
+		t := time.NewTicker(compactProgress)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				freed := r.Before - filesUsage(files)
+				if freed < 0 {
+					freed = 0
+				}
+				o.setProgress("%s reclaimed", units.BytesSize(float64(freed)))
+			}
+		}
+	}()
+	err = ploopCmdNice(d.dopts.ionice, "balloon", "discard", "--automount", d.dd(name))
+	close(stop)
+	if err != nil {
+		return nil, err
+	}
+
+	r.After = filesUsage(files)
+	r.Reclaimed = r.Before - r.After
+	r.Duration = time.Since(start).String()
+	o.log.Infof("Reclaimed %s", units.BytesSize(float64(r.Reclaimed)))
+
+	return &r, nil
+}
+
+// compactCheck checks if a volume can be compacted,
+// and returns its DiskDescriptor.xml
+func (d *ploopDriver) compactCheck(o *op, name string) (*diskdescriptor.Descriptor, error) {
+	if err := d.checkBroken(o, name); err != nil {
+		return nil, err
+	}
+	// ploop balloon only works with ext4
+	if err := d.checkExt4(name, "compact"); err != nil {
+		return nil, err
+	}
+	if err := d.checkEncrypted(name, "compact"); err != nil {
+		return nil, err
+	}
+
+	return diskdescriptor.Read(d.dd(name))
+}
+
+// compactDone records the time of the last compaction
+func (d *ploopDriver) compactDone(o *op, name string) {
+	m, err := d.loadMeta(name)
+	if err == nil {
+		m.LastCompact = time.Now()
+		err = d.saveMeta(name, m)
+	}
+	if err != nil {
+		o.log.Warnf("Can't save volume metadata: %s", err)
+	}
+}
+
+// compactDue returns the list of volumes due for scheduled compaction
+func (d *ploopDriver) compactDue() []string {
+	vols, err := d.list()
+	if err != nil {
+		logrus.Errorf("Can't list volumes: %s", err)
+		return nil
+	}
+
+	var names []string
+	for _, v := range vols {
+		if _, broken := v.Status[statusBroken]; broken {
+			continue
+		}
+		// Unmounted volumes don't change, and compacting them
+		// would keep them locked, so they are left until mounted
+		if !d.isMounted(v.Name) {
+			continue
+		}
+		m, err := d.loadMeta(v.Name)
+		if err != nil || (m.FSType != "" && m.FSType != fsExt4) || m.KeyID != "" {
+			continue
+		}
+		interval := d.opts.compact
+		if m.Compact != "" {
+			interval, _ = time.ParseDuration(m.Compact)
+		}
+		if interval <= 0 {
+			continue
+		}
+
+		last := m.LastCompact
+		if last.IsZero() {
+			// never compacted, count from volume creation
+			fi, err := os.Stat(d.dd(v.Name))
+			if err != nil {
+				continue
+			}
+			last = fi.ModTime()
+		}
+		if time.Since(last) >= interval {
+			names = append(names, v.Name)
+		}
+	}
+
+	return names
+}
+
+// compactLoop compacts volumes according to their schedules
+func (d *ploopDriver) compactLoop() {
+	for {
+		time.Sleep(compactCheck)
+		for _, name := range d.compactDue() {
+			if d.isStopping() {
+				return
+			}
+			o := newOp("compact", name)
+			o.ownLock = true
+			d.runAdmin(o, func() error {
+				_, err := d.compact(o, name)
+				return err
+			})
+		}
+	}
+}
+
+// adminCompact compacts a volume
+func (d *ploopDriver) adminCompact(r *http.Request) (interface{}, error) {
+	var res *compactResult
+
+	name := r.FormValue("volume")
+	if name == "" {
+		return nil, fmt.Errorf("Volume name is required")
+	}
+	if err := d.findVol(name); err != nil {
+		return nil, err
+	}
+	o := newOp("compact", name)
+	o.ownLock = true
+	err := d.runAdmin(o, func() (err error) {
+		res, err = d.compact(o, name)
+		return err
+	})
+
+	return res, err
+}
+
+func cmdCompact(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: compact VOLUME")
+	}
+
+	var r compactResult
+	if err := adminCall("POST", "/compact?volume="+url.QueryEscape(args[0]), nil, &r); err != nil {
+		return err
+	}
+
+	return printJSON(r)
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/docker/go-units"
+	"github.com/kolyshkin/docker-volume-ploop/delta"
+	"github.com/kolyshkin/docker-volume-ploop/diskdescriptor"
+	"github.com/kolyshkin/goploop"
+)
+
+/* Image mode conversion.
+ *
+ * Raw images are converted to and from ploop format by ploop itself,
+ * which can only be done offline.
+ *
+ * Conversion between expanded and preallocated images works online,
+ * too. The image is snapshotted, so its base delta is not changed any
+ * more, and the snapshot contents is copied to a new image of the
+ * required mode. The base delta is then replaced with the new one,
+ * and the snapshot is deleted, merging the changes made meanwhile.
+ *
+ * libploop can only replace a delta on a running device, so for an
+ * unmounted volume the new image is verified and switched to by
+ * replacing DiskDescriptor.xml, like relayout does.
+ */
+
+// Directory for a new image, inside the volume directory
+const convertDir = "convert.tmp"
+
+// Extra free space required for conversion, in percent
+const convertMargin = 5
+
+// convertResult is an outcome of volume conversion
+type convertResult struct {
+	Volume string
+	From   string
+	To     string
+}
+
+// imageMode finds out the mode of a volume image, and whether it is
+// known for sure. Raw images are told by DiskDescriptor.xml, but
+// expanded and preallocated ones only differ in how their clusters
+// are allocated, so the mode is recorded in volume metadata. If it's
+// not there (for volumes created by older versions), it is guessed:
+// ploop allocates all clusters of a preallocated image in order.
+func (d *ploopDriver) imageMode(name string, desc *diskdescriptor.Descriptor) (ploop.ImageMode, bool, error) {
+	base := desc.Chain()[0]
+	if base.Mode == diskdescriptor.Plain {
+		return ploop.Raw, true, nil
+	}
+
+	m, err := d.loadMeta(name)
+	if err != nil {
+		return 0, false, err
+	}
+	if mode, err := ploop.ParseImageMode(m.ImageMode); err == nil && mode != ploop.Raw {
+		return mode, true, nil
+	}
+
+	i, err := delta.Inspect(base.File)
+	if err != nil {
+		return 0, false, err
+	}
+	if i.Contiguous {
+		return ploop.Preallocated, false, nil
+	}
+
+	return ploop.Expanded, false, nil
+}
+
+// setImageMode records a volume image mode in its metadata
+func (d *ploopDriver) setImageMode(name string, mode ploop.ImageMode) error {
+	m, err := d.loadMeta(name)
+	if err != nil {
+		return err
+	}
+	m.ImageMode = strings.ToLower(mode.String())
+
+	return d.saveMeta(name, m)
+}
+
+// checkSpace makes sure there's enough free space in home
+// for a new image of a given size
+func (d *ploopDriver) checkSpace(need uint64) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(d.home, &st); err != nil {
+		return err
+	}
+
+	need += need * convertMargin / 100
+	avail := st.Bavail * uint64(st.Bsize)
+	if avail < need {
+		return fmt.Errorf("Not enough free space: %s needed, %s available",
+			units.BytesSize(float64(need)), units.BytesSize(float64(avail)))
+	}
+
+	return nil
+}
+
+// convert converts a volume image to a given mode
+func (d *ploopDriver) convert(o *op, name string, mode ploop.ImageMode) (*convertResult, error) {
+	if err := d.checkBroken(o, name); err != nil {
+		return nil, err
+	}
+	desc, err := diskdescriptor.Read(d.dd(name))
+	if err != nil {
+		return nil, err
+	}
+	if len(desc.Images) != 1 {
+		return nil, fmt.Errorf("Volume %s has snapshots, can't convert it", name)
+	}
+	cur, known, err := d.imageMode(name, desc)
+	if err != nil {
+		return nil, err
+	}
+	r := convertResult{Volume: name, From: cur.String(), To: mode.String()}
+	if cur == mode && known {
+		return nil, fmt.Errorf("Volume %s is already %s", name, mode)
+	}
+
+	need := uint64(filesUsage(desc.Files()))
+	if mode != ploop.Expanded {
+		need = desc.Size
+	}
+	if err := d.checkSpace(need); err != nil {
+		return nil, err
+	}
+
+	defer d.heavyOp(o)()
+	if !known {
+		o.log.Infof("Volume mode is not recorded, assuming %s", cur)
+	}
+	o.log.Infof("Converting volume from %s to %s", cur, mode)
+
+	needCopy := mode != ploop.Raw
+	if cur == ploop.Raw || mode == ploop.Raw {
+		if err := d.convertFormat(o, name, mode); err != nil {
+			return nil, err
+		}
+		// ploop gives us an expanded image, so copy it if needed
+		needCopy = mode == ploop.Preallocated
+		if desc, err = diskdescriptor.Read(d.dd(name)); err != nil {
+			return nil, err
+		}
+	}
+
+	if needCopy {
+		if err := d.convertCopy(o, name, desc, mode); err != nil {
+			return nil, err
+		}
+	}
+	if err := d.setImageMode(name, mode); err != nil {
+		o.log.Warnf("Can't record image mode: %s", err)
+	}
+
+	// Double check the outcome
+	if mode == ploop.Preallocated {
+		if desc, err = diskdescriptor.Read(d.dd(name)); err == nil {
+			if i, err := delta.Inspect(desc.Chain()[0].File); err == nil && !i.Contiguous {
+				o.log.Warnf("Volume is not fully preallocated after conversion")
+			}
+		}
+	}
+
+	return &r, nil
+}
+
+// convertFormat converts an unmounted image to or from raw format
+func (d *ploopDriver) convertFormat(o *op, name string, mode ploop.ImageMode) error {
+	p, err := ploop.Open(d.dd(name))
+	if err != nil {
+		return err
+	}
+	m, _ := p.IsMounted()
+	p.Close()
+	if m {
+		return fmt.Errorf("Volume %s is mounted, can only convert to or from raw offline", name)
+	}
+
+	format := "ploop1"
+	if mode == ploop.Raw {
+		format = "raw"
+	}
+
+	return ploopCmd("convert", "-f", format, d.dd(name))
+}
+
+// convertCopy converts an image between expanded and preallocated
+// modes by copying it
+func (d *ploopDriver) convertCopy(o *op, name string, desc *diskdescriptor.Descriptor, mode ploop.ImageMode) (err error) {
+	tmp := path.Join(d.dir(name), convertDir)
+
+	j, err := d.journalBegin(o, nil)
+	if err != nil {
+		return err
+	}
+	defer d.journalDone(j, &err)
+
+	p, err := ploop.Open(d.dd(name))
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	defer os.RemoveAll(tmp)
+
+	if m, _ := p.IsMounted(); m {
+		return d.convertOnline(o, name, p, j, desc, mode)
+	}
+
+	return d.convertOffline(o, name, p, j, desc, mode)
+}
+
+// convertCreate creates a new image of a given mode in the volume
+// temporary directory, with the same size and cluster block size
+// as the one described by desc, and returns its delta file name
+func (d *ploopDriver) convertCreate(name string, desc *diskdescriptor.Descriptor, mode ploop.ImageMode) (string, error) {
+	tmp := path.Join(d.dir(name), convertDir)
+	os.RemoveAll(tmp)
+	if err := os.Mkdir(tmp, 0700); err != nil {
+		return "", err
+	}
+
+	uuid, err := ploop.UUID()
+	if err != nil {
+		return "", err
+	}
+	clog := uint(0)
+	for b := desc.BlockSize / diskdescriptor.SectorSize; b > 1; b >>= 1 {
+		clog++
+	}
+	file := path.Join(tmp, imagePrefix+"."+uuid)
+	cp := ploop.CreateParam{Size: desc.Size >> 10, Mode: mode, File: file, CLog: clog, Flags: ploop.NoLazy}
+	if err := ploop.Create(&cp); err != nil {
+		return "", err
+	}
+
+	return file, nil
+}
+
+// convertOnline converts an image of a mounted volume, replacing
+// its base delta on the running device
+func (d *ploopDriver) convertOnline(o *op, name string, p ploop.Ploop, j *intent, desc *diskdescriptor.Descriptor, mode ploop.ImageMode) (err error) {
+	// Freeze the base delta, so it can be copied. The new top delta
+	// gets the old top GUID, while the base gets the snapshot GUID.
+	guid, err := p.Snapshot()
+	if err != nil {
+		return err
+	}
+	j.Args = map[string]string{"snapshot": guid}
+	if err := d.journalStep(j, "snapshot"); err != nil {
+		return err
+	}
+	defer func() {
+		// Merge the changes made meanwhile into the base delta
+		if e := p.DeleteSnapshot(guid); e != nil {
+			o.log.Errorf("Can't delete snapshot %s: %s", guid, e)
+			if err == nil {
+				err = e
+			}
+		}
+	}()
+
+	file, err := d.convertCreate(name, desc, mode)
+	if err != nil {
+		return err
+	}
+	if err := d.journalStep(j, "create"); err != nil {
+		return err
+	}
+
+	// The top delta is mounted, so the base one is attached
+	// to another device, using another handle
+	src, err := ploop.Open(d.dd(name))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := ploop.Open(path.Join(path.Dir(file), ddxml))
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	if err := d.copyLevel(o, src, dst, guid, desc.BlockSize); err != nil {
+		return err
+	}
+
+	// Put the new delta in place of the old one
+	if err := p.Replace(&ploop.ReplaceParam{File: file, UUID: guid, Flags: ploop.KeepName}); err != nil {
+		return err
+	}
+
+	return d.journalStep(j, "replace")
+}
+
+// convertOffline converts an image of an unmounted volume. libploop
+// can only replace a delta on a running device, so the new image is
+// verified and switched to by replacing DiskDescriptor.xml, the same
+// way relayout does it.
+func (d *ploopDriver) convertOffline(o *op, name string, p ploop.Ploop, j *intent, desc *diskdescriptor.Descriptor, mode ploop.ImageMode) error {
+	file, err := d.convertCreate(name, desc, mode)
+	if err != nil {
+		return err
+	}
+	if err := d.journalStep(j, "create"); err != nil {
+		return err
+	}
+
+	tmp := path.Dir(file)
+	np, err := ploop.Open(path.Join(tmp, ddxml))
+	if err != nil {
+		return err
+	}
+	defer np.Close()
+	if err := d.copyLevel(o, p, np, "", desc.BlockSize); err != nil {
+		return err
+	}
+	if err := d.verifyLevel(o, p, np, "", "", desc.BlockSize); err != nil {
+		return err
+	}
+
+	// Move the new delta in, and switch to the new image
+	old := desc.Chain()[0].File
+	newFile := path.Join(d.dir(name), path.Base(file))
+	j.Args = map[string]string{"old": old, "new": newFile}
+	if err := d.journalStep(j, "move"); err != nil {
+		return err
+	}
+	if err := os.Rename(file, newFile); err != nil {
+		return err
+	}
+	if err := d.switchDD(path.Join(tmp, ddxml), d.dd(name), tmp); err != nil {
+		os.Remove(newFile)
+		return err
+	}
+	if err := d.journalStep(j, "switch"); err != nil {
+		return err
+	}
+	if err := os.Remove(old); err != nil {
+		o.log.Warnf("Can't remove old delta: %s", err)
+	}
+
+	return nil
+}
+
+// recoverConvert cleans up after an unfinished conversion. The image
+// itself is consistent at any step, but might be left with a snapshot
+// (if converted online), or an unused delta (if offline).
+func recoverConvert(d *ploopDriver, i *intent) error {
+	tmp := path.Join(d.dir(i.Volume), convertDir)
+	if p, err := ploop.Open(path.Join(tmp, ddxml)); err == nil {
+		p.Umount()
+		p.Close()
+	}
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+
+	if guid := i.Args["snapshot"]; guid != "" {
+		p, err := ploop.Open(d.dd(i.Volume))
+		if err != nil {
+			return err
+		}
+		defer p.Close()
+		return p.DeleteSnapshot(guid)
+	}
+
+	return removeUnused(d, i.Volume, []string{i.Args["old"], i.Args["new"]})
+}
+
+// adminConvert converts a volume to a different image mode
+func (d *ploopDriver) adminConvert(r *http.Request) (interface{}, error) {
+	var res *convertResult
+
+	name := r.FormValue("volume")
+	if name == "" {
+		return nil, fmt.Errorf("Volume name is required")
+	}
+	if err := d.findVol(name); err != nil {
+		return nil, err
+	}
+	mode, err := ploop.ParseImageMode(r.FormValue("mode"))
+	if err != nil {
+		return nil, fmt.Errorf("Can't parse mode %s: %s", r.FormValue("mode"), err)
+	}
+
+	o := newOp("convert", name)
+	err = d.runTimeout(o, map[string]string{"mode": r.FormValue("mode")}, 0, func() (err error) {
+		res, err = d.convert(o, name, mode)
+		return err
+	}, nil)
+
+	return res, err
+}
+
+func cmdConvert(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("Usage: convert VOLUME MODE")
+	}
+
+	q := url.Values{}
+	q.Set("volume", args[0])
+	q.Set("mode", args[1])
+
+	var r convertResult
+	if err := adminCall("POST", "/convert?"+q.Encode(), nil, &r); err != nil {
+		return err
+	}
+
+	return printJSON(r)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/kolyshkin/goploop"
+)
+
+/* Encrypted volumes.
+ *
+ * libploop can't encrypt images by itself, so the partition of
+ * a ploop device is formatted as LUKS by cryptsetup, and the inner
+ * filesystem is created on top of it. On mount, the ploop device is
+ * attached, the LUKS device is opened with the volume key, and the
+ * filesystem is mounted by the driver itself.
+ *
+ * The key is only passed to cryptsetup via a pipe, and is never
+ * written to disk by the driver. See keys.go for key providers.
+ */
+
+// Mount options for journaled quota, as ploop uses
+const quotaMountData = "usrjquota=aquota.user,grpjquota=aquota.group,jqfmt=vfsv0"
+
+// cryptName returns a device mapper name for an encrypted volume
+func cryptName(name string) string {
+	return "ploop-" + name
+}
+
+// cryptDev returns a device to mount for an encrypted volume
+func cryptDev(name string) string {
+	return path.Join("/dev/mapper", cryptName(name))
+}
+
+// keyFile returns a path to n-th key passed to cryptsetup
+func keyFile(n int) string {
+	return fmt.Sprintf("/dev/fd/%d", 3+n)
+}
+
+// cryptsetup runs cryptsetup, passing keys to it as keyFile(0),
+// keyFile(1) and so on
+func cryptsetup(keys [][]byte, args ...string) error {
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, key := range keys {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		files = append(files, r)
+		// keys are small enough to fit into a pipe buffer
+		_, err = w.Write(key)
+		w.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return runCmdFiles(nil, files, "cryptsetup", args...)
+}
+
+// checkCrypt checks if encrypted volumes can be used
+func (d *ploopDriver) checkCrypt() error {
+	if d.dopts.keys == nil {
+		return fmt.Errorf("No key provider is set (see -key-provider flag)")
+	}
+	if _, err := exec.LookPath("cryptsetup"); err != nil {
+		return fmt.Errorf("Can't use encryption: %s", err)
+	}
+
+	return nil
+}
+
+// volumeKey gets an encryption key of a volume
+func (d *ploopDriver) volumeKey(name, id string) ([]byte, error) {
+	if err := d.checkCrypt(); err != nil {
+		return nil, err
+	}
+	key, err := d.dopts.keys.getKey(id)
+	if err != nil {
+		return nil, fmt.Errorf("Can't get encryption key %s for volume %s: %s", id, name, err)
+	}
+
+	return key, nil
+}
+
+// newKeyID generates a new encryption key ID
+func newKeyID() (string, error) {
+	uuid, err := ploop.UUID()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Trim(uuid, "{}"), nil
+}
+
+// encrypt formats a newly created volume as LUKS with a new key,
+// creates the inner filesystem, and returns the key ID
+func (d *ploopDriver) encrypt(o *op, name string, m *mkfsOptions) (string, error) {
+	id, err := newKeyID()
+	if err != nil {
+		return "", err
+	}
+	key, err := d.dopts.keys.newKey(id)
+	if err != nil {
+		return "", fmt.Errorf("Can't get a new encryption key: %s", err)
+	}
+
+	p, err := ploop.Open(d.dd(name))
+	if err != nil {
+		return "", err
+	}
+	defer p.Close()
+
+	dev, err := p.Mount(&ploop.MountParam{})
+	if err != nil {
+		return "", err
+	}
+	defer p.Umount()
+
+	o.log.Debugf("Encrypting volume, key %s", id)
+	part := dev + "p1"
+	keys := [][]byte{key}
+	if err := cryptsetup(keys, "luksFormat", "--batch-mode", "--key-file="+keyFile(0), part); err != nil {
+		return "", err
+	}
+	if err := cryptsetup(keys, "open", "--key-file="+keyFile(0), part, cryptName(name)); err != nil {
+		return "", err
+	}
+	defer cryptsetup(nil, "close", cryptName(name))
+
+	if err := mkfsDev(o, cryptDev(name), m); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// mountFS is like ploop Mount, but also handles encrypted volumes
+// and filesystems other than ext4, which libploop can't mount itself
+func (d *ploopDriver) mountFS(o *op, p ploop.Ploop, name string, meta *volumeMeta, mp *ploop.MountParam) (string, error) {
+	if ploopMountable(meta) {
+		return p.Mount(mp)
+	}
+
+	// Refuse to do anything without a key
+	var key []byte
+	if meta.KeyID != "" {
+		var err error
+		if key, err = d.volumeKey(name, meta.KeyID); err != nil {
+			return "", err
+		}
+	}
+
+	dev, err := p.Mount(&ploop.MountParam{Readonly: mp.Readonly})
+	if err != nil {
+		return "", err
+	}
+	part := dev + "p1"
+	if key != nil {
+		args := []string{"open", "--key-file=" + keyFile(0)}
+		if mp.Readonly {
+			args = append(args, "--readonly")
+		}
+		if err := cryptsetup([][]byte{key}, append(args, part, cryptName(name))...); err != nil {
+			p.Umount()
+			return "", err
+		}
+		part = cryptDev(name)
+	}
+	if mp.Target == "" {
+		return dev, nil
+	}
+	cleanup := func() {
+		if key != nil {
+			cryptsetup(nil, "close", cryptName(name))
+		}
+		p.Umount()
+	}
+
+	fstype := volumeFSType(meta)
+	if mp.Fsck {
+		args, maxCode := fsckArgs(fstype, part)
+		if err := runCmd(nil, args[0], args[1:]...); err != nil {
+			if e, ok := err.(*Err); !ok || e.c < 0 || e.c > maxCode {
+				cleanup()
+				return "", err
+			}
+		}
+	}
+	data := mp.Data
+	if mp.Quota {
+		data = addMountData(data, quotaMountData)
+	}
+	flags := uintptr(mp.Flags)
+	if mp.Readonly {
+		flags |= syscall.MS_RDONLY
+	}
+	if err := syscall.Mount(part, mp.Target, fstype, flags, data); err != nil {
+		cleanup()
+		return "", fmt.Errorf("Can't mount %s: %s", part, err)
+	}
+
+	return dev, nil
+}
+
+// umountFS is like ploop Umount, but also unmounts filesystems
+// mounted by mountFS itself
+func (d *ploopDriver) umountFS(o *op, p ploop.Ploop, name string, meta *volumeMeta) error {
+	if !ploopMountable(meta) {
+		// EINVAL means it's not mounted
+		if err := syscall.Unmount(d.mnt(name), 0); err != nil && err != syscall.EINVAL {
+			return fmt.Errorf("Can't unmount %s: %s", d.mnt(name), err)
+		}
+	}
+	if meta.KeyID != "" {
+		if _, err := os.Stat(cryptDev(name)); err == nil {
+			if err := cryptsetup(nil, "close", cryptName(name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return p.Umount()
+}
+
+// checkEncrypted returns an error if the volume is encrypted,
+// for operations which can't work with encrypted volumes
+func (d *ploopDriver) checkEncrypted(name, what string) error {
+	m, err := d.loadMeta(name)
+	if err != nil {
+		return err
+	}
+	if m.KeyID != "" {
+		return fmt.Errorf("Can't %s volume %s: it is encrypted", what, name)
+	}
+
+	return nil
+}
+
+// rotateKeyResult is an outcome of encryption key rotation
+type rotateKeyResult struct {
+	Volume   string
+	OldKeyID string
+	NewKeyID string
+}
+
+// rotateKey replaces a volume encryption key with a new one. The old
+// key is removed from the volume, but is left to the key provider.
+func (d *ploopDriver) rotateKey(o *op, name string) (*rotateKeyResult, error) {
+	if err := d.checkBroken(o, name); err != nil {
+		return nil, err
+	}
+	meta, err := d.loadMeta(name)
+	if err != nil {
+		return nil, err
+	}
+	if meta.KeyID == "" {
+		return nil, fmt.Errorf("Volume %s is not encrypted", name)
+	}
+	oldKey, err := d.volumeKey(name, meta.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	r := rotateKeyResult{Volume: name, OldKeyID: meta.KeyID}
+
+	// Find the LUKS device, attaching the image if needed
+	p, err := ploop.Open(d.dd(name))
+	if err != nil {
+		return nil, err
+	}
+	defer p.Close()
+	var dev string
+	if m, _ := p.IsMounted(); m {
+		devs, err := d.ploopDevices()
+		if err != nil {
+			return nil, err
+		}
+		if len(devs[name]) != 1 {
+			return nil, fmt.Errorf("Can't find volume %s device (found %v)", name, devs[name])
+		}
+		dev = path.Join("/dev", devs[name][0])
+	} else {
+		if dev, err = p.Mount(&ploop.MountParam{}); err != nil {
+			return nil, err
+		}
+		defer p.Umount()
+	}
+	part := dev + "p1"
+
+	if r.NewKeyID, err = newKeyID(); err != nil {
+		return nil, err
+	}
+	newKey, err := d.dopts.keys.newKey(r.NewKeyID)
+	if err != nil {
+		return nil, fmt.Errorf("Can't get a new encryption key: %s", err)
+	}
+
+	o.log.Infof("Rotating encryption key %s to %s", r.OldKeyID, r.NewKeyID)
+	if err := cryptsetup([][]byte{oldKey, newKey}, "luksAddKey", "--key-file="+keyFile(0), part, keyFile(1)); err != nil {
+		return nil, err
+	}
+	meta.KeyID = r.NewKeyID
+	if err := d.saveMeta(name, meta); err != nil {
+		cryptsetup([][]byte{newKey}, "luksRemoveKey", part, keyFile(0))
+		return nil, err
+	}
+	if err := cryptsetup([][]byte{oldKey}, "luksRemoveKey", part, keyFile(0)); err != nil {
+		// not fatal, the new key works anyway
+		o.log.Warnf("Can't remove old key %s: %s", r.OldKeyID, err)
+	}
+
+	return &r, nil
+}
+
+// adminRotateKey replaces a volume encryption key
+func (d *ploopDriver) adminRotateKey(r *http.Request) (interface{}, error) {
+	var res *rotateKeyResult
+
+	name := r.FormValue("volume")
+	if name == "" {
+		return nil, fmt.Errorf("Volume name is required")
+	}
+	if err := d.findVol(name); err != nil {
+		return nil, err
+	}
+	o := newOp("rotate-key", name)
+	err := d.runAdmin(o, func() (err error) {
+		res, err = d.rotateKey(o, name)
+		return err
+	})
+
+	return res, err
+}
+
+func cmdRotateKey(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: rotate-key VOLUME")
+	}
+
+	var r rotateKeyResult
+	if err := adminCall("POST", "/rotate-key?volume="+url.QueryEscape(args[0]), nil, &r); err != nil {
+		return err
+	}
+
+	return printJSON(r)
+}
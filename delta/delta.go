@@ -0,0 +1,246 @@
+// Package delta reads ploop delta files directly, without libploop
+// or the ploop kernel module. It can be used to inspect images offline:
+// get the format version, sizes and the number of allocated clusters,
+// and verify the block allocation table (BAT).
+package delta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// Delta header signatures, for format versions 1 and 2
+const (
+	sigV1 = "WithoutFreeSpace"
+	sigV2 = "WithouFreSpacExt"
+)
+
+// Value of the in-use field of a header of an image which is open
+// (mounted), or was not closed properly
+const diskInUse = 0x746F6E59
+
+// Sizes of on-disk structures
+const (
+	sectorSize = 512
+	headerSize = 64
+	batEntry   = 4
+)
+
+// Max number of BAT errors to report
+const maxErrors = 10
+
+// Number of BAT entries to read at once
+const batChunk = 64 << 10
+
+// pvdHeader is a delta header as it is stored on disk (little endian)
+type pvdHeader struct {
+	Sig              [16]byte
+	Type             uint32
+	Heads            uint32
+	Cylinders        uint32
+	Sectors          uint32 // cluster size, in sectors
+	Size             uint32 // number of BAT entries
+	SizeInSectors    uint64 // virtual size (v1 only uses the lower half)
+	DiskInUse        uint32
+	FirstBlockOffset uint32 // in sectors
+	Flags            uint32
+	Reserved         [8]byte
+}
+
+// Header is a parsed delta header
+type Header struct {
+	Version          int
+	Size             uint64 // virtual disk size, in bytes
+	ClusterSize      uint64 // in bytes
+	BATEntries       uint32
+	FirstBlockOffset uint64 // offset of the first data cluster, in bytes
+	InUse            bool   // image is mounted, or was not cleanly closed
+	Flags            uint32
+}
+
+// Info is an outcome of delta inspection
+type Info struct {
+	File string
+	Raw  bool // a raw image, with no header
+	*Header
+	Allocated  uint64   // number of allocated clusters
+	Contiguous bool     // all clusters are allocated in order, right after the BAT
+	FileSize   int64    // apparent file size, in bytes
+	DiskUsage  int64    // space used on disk, in bytes
+	Errors     []string `json:",omitempty"` // BAT consistency problems
+}
+
+// ReadHeader reads and validates a delta header
+func ReadHeader(r io.ReaderAt) (*Header, error) {
+	var p pvdHeader
+
+	buf := make([]byte, headerSize)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return nil, fmt.Errorf("Can't read header: %s", err)
+	}
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &p); err != nil {
+		return nil, err
+	}
+
+	h := Header{
+		ClusterSize:      uint64(p.Sectors) * sectorSize,
+		BATEntries:       p.Size,
+		FirstBlockOffset: uint64(p.FirstBlockOffset) * sectorSize,
+		InUse:            p.DiskInUse == diskInUse,
+		Flags:            p.Flags,
+	}
+	switch string(p.Sig[:]) {
+	case sigV1:
+		h.Version = 1
+		h.Size = (p.SizeInSectors & 0xffffffff) * sectorSize
+	case sigV2:
+		h.Version = 2
+		h.Size = p.SizeInSectors * sectorSize
+	default:
+		return nil, fmt.Errorf("Not a ploop delta (bad signature)")
+	}
+
+	if h.ClusterSize == 0 || h.ClusterSize&(h.ClusterSize-1) != 0 {
+		return nil, fmt.Errorf("Invalid cluster size %d", h.ClusterSize)
+	}
+	if h.Size > uint64(h.BATEntries)*h.ClusterSize {
+		return nil, fmt.Errorf("Disk size %d does not fit into %d clusters", h.Size, h.BATEntries)
+	}
+	if h.FirstBlockOffset%h.ClusterSize != 0 ||
+		h.FirstBlockOffset < headerSize+uint64(h.BATEntries)*batEntry {
+		return nil, fmt.Errorf("Invalid first block offset %d", h.FirstBlockOffset)
+	}
+
+	return &h, nil
+}
+
+// Inspect reads a delta header and its BAT, counting allocated
+// clusters and checking that they are within the file and do not
+// overlap with each other or the BAT
+func Inspect(file string) (*Info, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	i, err := stat(f)
+	if err != nil {
+		return nil, err
+	}
+	i.Header, err = ReadHeader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := i.readBAT(f); err != nil {
+		return nil, err
+	}
+
+	return i, nil
+}
+
+// InspectRaw returns information about a raw image
+func InspectRaw(file string) (*Info, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	i, err := stat(f)
+	if err != nil {
+		return nil, err
+	}
+	i.Raw = true
+
+	return i, nil
+}
+
+func stat(f *os.File) (*Info, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	i := Info{File: f.Name(), FileSize: fi.Size()}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		i.DiskUsage = st.Blocks * sectorSize
+	}
+
+	return &i, nil
+}
+
+func (i *Info) addError(format string, args ...interface{}) {
+	if len(i.Errors) == maxErrors {
+		i.Errors = append(i.Errors, "(more errors follow)")
+	}
+	if len(i.Errors) <= maxErrors {
+		i.Errors = append(i.Errors, fmt.Sprintf(format, args...))
+	}
+}
+
+// readBAT reads the BAT, counting and verifying allocated clusters
+func (i *Info) readBAT(f *os.File) error {
+	h := i.Header
+	fileClusters := uint64(i.FileSize) / h.ClusterSize
+	used := make([]uint64, (fileClusters+63)/64) // bitmap of clusters in use
+
+	i.Contiguous = h.BATEntries > 0
+	buf := make([]byte, batChunk*batEntry)
+	r := io.NewSectionReader(f, headerSize, int64(h.BATEntries)*batEntry)
+	for n := uint32(0); n < h.BATEntries; {
+		cnt := h.BATEntries - n
+		if cnt > batChunk {
+			cnt = batChunk
+		}
+		b := buf[:cnt*batEntry]
+		if _, err := io.ReadFull(r, b); err != nil {
+			return fmt.Errorf("Can't read BAT: %s", err)
+		}
+		for k := uint32(0); k < cnt; k++ {
+			i.checkEntry(n+k, binary.LittleEndian.Uint32(b[k*batEntry:]), fileClusters, used)
+		}
+		n += cnt
+	}
+
+	return nil
+}
+
+// checkEntry accounts and verifies BAT entry e for cluster n
+func (i *Info) checkEntry(n, e uint32, fileClusters uint64, used []uint64) {
+	if e == 0 {
+		i.Contiguous = false
+		return
+	}
+	i.Allocated++
+
+	// v1 entries are in sectors, v2 ones are in clusters
+	h := i.Header
+	c := uint64(e)
+	if h.Version == 1 {
+		if (c*sectorSize)%h.ClusterSize != 0 {
+			i.addError("Cluster %d: unaligned offset %d", n, c*sectorSize)
+			i.Contiguous = false
+			return
+		}
+		c = c * sectorSize / h.ClusterSize
+	}
+	if c != h.FirstBlockOffset/h.ClusterSize+uint64(n) {
+		i.Contiguous = false
+	}
+	switch {
+	case c < h.FirstBlockOffset/h.ClusterSize:
+		i.addError("Cluster %d: offset %d overlaps with BAT", n, c*h.ClusterSize)
+	case c >= fileClusters:
+		i.addError("Cluster %d: offset %d is beyond end of file", n, c*h.ClusterSize)
+	case used[c/64]&(1<<(c%64)) != 0:
+		i.addError("Cluster %d: offset %d is used more than once", n, c*h.ClusterSize)
+	default:
+		used[c/64] |= 1 << (c % 64)
+	}
+}
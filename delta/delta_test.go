@@ -0,0 +1,439 @@
+package delta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// Cluster size used by synthetic images, in sectors
+const testSectors = 8
+
+// image describes a synthetic delta
+type image struct {
+	sig      string
+	sectors  uint32 // cluster size
+	size     uint64 // virtual size, in sectors
+	first    uint32 // first block offset, in sectors
+	inUse    bool
+	bat      []uint32
+	clusters uint64 // file size, in clusters
+}
+
+// newImage returns a valid delta of a given version, with the BAT
+// fitting into the first cluster, and n clusters allocated
+func newImage(version int, entries, n int) image {
+	i := image{
+		sig:      sigV2,
+		sectors:  testSectors,
+		size:     uint64(entries * testSectors),
+		first:    testSectors,
+		bat:      make([]uint32, entries),
+		clusters: uint64(n + 1),
+	}
+	if version == 1 {
+		i.sig = sigV1
+	}
+	for c := 0; c < n; c++ {
+		i.bat[c] = i.entry(uint32(c + 1))
+	}
+
+	return i
+}
+
+// entry returns a BAT entry pointing to cluster c
+func (i image) entry(c uint32) uint32 {
+	if i.sig == sigV1 {
+		return c * i.sectors
+	}
+
+	return c
+}
+
+func (i image) bytes() []byte {
+	p := pvdHeader{
+		Type:             2,
+		Heads:            16,
+		Cylinders:        uint32(i.size / 16 / 63),
+		Sectors:          i.sectors,
+		Size:             uint32(len(i.bat)),
+		SizeInSectors:    i.size,
+		FirstBlockOffset: i.first,
+	}
+	copy(p.Sig[:], i.sig)
+	if i.inUse {
+		p.DiskInUse = diskInUse
+	}
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, &p)
+	binary.Write(&b, binary.LittleEndian, i.bat)
+	// the file is exactly the given number of clusters,
+	// even if it cuts the BAT
+	if size := int(i.clusters * uint64(i.sectors) * sectorSize); size > b.Len() {
+		b.Write(make([]byte, size-b.Len()))
+	} else if size >= headerSize {
+		b.Truncate(size)
+	}
+
+	return b.Bytes()
+}
+
+// write writes a synthetic delta to a temporary file
+func (i image) write(t *testing.T, dir string) string {
+	f, err := ioutil.TempFile(dir, "delta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(i.bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	return f.Name()
+}
+
+func TestReadHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		img     func() image
+		version int
+		size    uint64
+		err     string
+	}{
+		{
+			name:    "v1",
+			img:     func() image { return newImage(1, 16, 0) },
+			version: 1,
+			size:    16 * testSectors * sectorSize,
+		},
+		{
+			name: "v1 ignores high size bits",
+			img: func() image {
+				i := newImage(1, 16, 0)
+				i.size |= 1 << 40
+				return i
+			},
+			version: 1,
+			size:    16 * testSectors * sectorSize,
+		},
+		{
+			name:    "v2",
+			img:     func() image { return newImage(2, 16, 0) },
+			version: 2,
+			size:    16 * testSectors * sectorSize,
+		},
+		{
+			name: "v2 partial last cluster",
+			img: func() image {
+				i := newImage(2, 16, 0)
+				i.size--
+				return i
+			},
+			version: 2,
+			size:    (16*testSectors - 1) * sectorSize,
+		},
+		{
+			name: "bad signature",
+			img: func() image {
+				i := newImage(2, 16, 0)
+				i.sig = "WithFreeSpace..."
+				return i
+			},
+			err: "bad signature",
+		},
+		{
+			name: "zero cluster size",
+			img: func() image {
+				i := newImage(2, 16, 0)
+				i.sectors = 0
+				return i
+			},
+			err: "Invalid cluster size 0",
+		},
+		{
+			name: "cluster size not a power of 2",
+			img: func() image {
+				i := newImage(2, 16, 0)
+				i.sectors = 6
+				return i
+			},
+			err: "Invalid cluster size",
+		},
+		{
+			name: "size too big",
+			img: func() image {
+				i := newImage(2, 16, 0)
+				i.size++
+				return i
+			},
+			err: "does not fit",
+		},
+		{
+			name: "unaligned first block",
+			img: func() image {
+				i := newImage(2, 16, 0)
+				i.first = testSectors + 1
+				return i
+			},
+			err: "Invalid first block offset",
+		},
+		{
+			name: "first block overlaps BAT",
+			img: func() image {
+				i := newImage(2, 2048, 0)
+				i.first = testSectors
+				return i
+			},
+			err: "Invalid first block offset",
+		},
+	}
+
+	for _, tc := range tests {
+		h, err := ReadHeader(bytes.NewReader(tc.img().bytes()))
+		if tc.err != "" {
+			if err == nil {
+				t.Errorf("%s: no error", tc.name)
+			} else if !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: error %q, expected %q", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.name, err)
+			continue
+		}
+		if h.Version != tc.version {
+			t.Errorf("%s: version %d, expected %d", tc.name, h.Version, tc.version)
+		}
+		if h.Size != tc.size {
+			t.Errorf("%s: size %d, expected %d", tc.name, h.Size, tc.size)
+		}
+		if h.ClusterSize != testSectors*sectorSize {
+			t.Errorf("%s: cluster size %d", tc.name, h.ClusterSize)
+		}
+		if h.FirstBlockOffset != testSectors*sectorSize {
+			t.Errorf("%s: first block offset %d", tc.name, h.FirstBlockOffset)
+		}
+	}
+
+	if _, err := ReadHeader(bytes.NewReader(make([]byte, headerSize-1))); err == nil {
+		t.Error("short header: no error")
+	}
+}
+
+func TestInspect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name       string
+		img        func(version int) image
+		allocated  uint64
+		contiguous bool
+		inUse      bool
+		errors     []string // expected BAT errors substrings
+		err        string
+	}{
+		{
+			name:      "empty",
+			img:       func(v int) image { return newImage(v, 16, 0) },
+			allocated: 0,
+		},
+		{
+			name:      "allocated",
+			img:       func(v int) image { return newImage(v, 16, 5) },
+			allocated: 5,
+		},
+		{
+			name:       "fully allocated",
+			img:        func(v int) image { return newImage(v, 16, 16) },
+			allocated:  16,
+			contiguous: true,
+		},
+		{
+			name: "fully allocated, out of order",
+			img: func(v int) image {
+				i := newImage(v, 16, 16)
+				i.bat[0], i.bat[15] = i.bat[15], i.bat[0]
+				return i
+			},
+			allocated: 16,
+		},
+		{
+			name: "sparse, in use",
+			img: func(v int) image {
+				i := newImage(v, 16, 0)
+				i.bat[3] = i.entry(2)
+				i.bat[15] = i.entry(1)
+				i.clusters = 3
+				i.inUse = true
+				return i
+			},
+			allocated: 2,
+			inUse:     true,
+		},
+		{
+			name: "more than a BAT chunk",
+			img: func(v int) image {
+				i := newImage(v, batChunk+100, 0)
+				i.first = uint32((headerSize+len(i.bat)*batEntry)/(testSectors*sectorSize)+1) * testSectors
+				c := i.first / testSectors
+				i.bat[0] = i.entry(c)
+				i.bat[batChunk+99] = i.entry(c + 1)
+				i.clusters = uint64(c + 2)
+				return i
+			},
+			allocated: 2,
+		},
+		{
+			name: "beyond end of file",
+			img: func(v int) image {
+				i := newImage(v, 16, 2)
+				i.bat[5] = i.entry(3)
+				return i
+			},
+			allocated: 3,
+			errors:    []string{"Cluster 5: offset 12288 is beyond end of file"},
+		},
+		{
+			name: "used twice",
+			img: func(v int) image {
+				i := newImage(v, 16, 2)
+				i.bat[7] = i.entry(1)
+				return i
+			},
+			allocated: 3,
+			errors:    []string{"Cluster 7: offset 4096 is used more than once"},
+		},
+		{
+			name: "overlaps BAT",
+			img: func(v int) image {
+				i := newImage(v, 16, 0)
+				i.first = 2 * testSectors
+				i.bat[0] = i.entry(1)
+				i.bat[1] = i.entry(2)
+				i.clusters = 3
+				return i
+			},
+			allocated: 2,
+			errors:    []string{"Cluster 0: offset 4096 overlaps with BAT"},
+		},
+		{
+			name: "too many errors",
+			img: func(v int) image {
+				i := newImage(v, 32, 0)
+				for n := range i.bat {
+					i.bat[n] = i.entry(100)
+				}
+				return i
+			},
+			allocated: 32,
+			errors: append(
+				strings.Split(strings.Repeat("beyond end of file\n", maxErrors), "\n")[:maxErrors],
+				"(more errors follow)"),
+		},
+		{
+			name: "truncated BAT",
+			img: func(v int) image {
+				i := newImage(v, 2048, 0)
+				i.first = 3 * testSectors
+				i.clusters = 1
+				return i
+			},
+			err: "Can't read BAT",
+		},
+	}
+
+	for _, v := range []int{1, 2} {
+		for _, tc := range tests {
+			file := tc.img(v).write(t, dir)
+			i, err := Inspect(file)
+			if tc.err != "" {
+				if err == nil {
+					t.Errorf("v%d %s: no error", v, tc.name)
+				} else if !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("v%d %s: error %q, expected %q", v, tc.name, err, tc.err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("v%d %s: unexpected error: %s", v, tc.name, err)
+				continue
+			}
+			if i.Version != v {
+				t.Errorf("v%d %s: version %d", v, tc.name, i.Version)
+			}
+			if i.Allocated != tc.allocated {
+				t.Errorf("v%d %s: allocated %d, expected %d", v, tc.name, i.Allocated, tc.allocated)
+			}
+			if i.Contiguous != tc.contiguous {
+				t.Errorf("v%d %s: contiguous %v, expected %v", v, tc.name, i.Contiguous, tc.contiguous)
+			}
+			if i.InUse != tc.inUse {
+				t.Errorf("v%d %s: in use %v, expected %v", v, tc.name, i.InUse, tc.inUse)
+			}
+			if len(i.Errors) != len(tc.errors) {
+				t.Errorf("v%d %s: errors %q, expected %q", v, tc.name, i.Errors, tc.errors)
+				continue
+			}
+			for n := range tc.errors {
+				if !strings.Contains(i.Errors[n], tc.errors[n]) {
+					t.Errorf("v%d %s: error %q, expected %q", v, tc.name, i.Errors[n], tc.errors[n])
+				}
+			}
+		}
+	}
+}
+
+func TestInspectV1Unaligned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	img := newImage(1, 16, 2)
+	img.bat[4] = 3 * testSectors / 2
+	i, err := Inspect(img.write(t, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(i.Errors) != 1 || !strings.Contains(i.Errors[0], "Cluster 4: unaligned offset 6144") {
+		t.Errorf("errors %q, expected an unaligned offset", i.Errors)
+	}
+}
+
+func TestInspectRaw(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "raw")
+	if err := ioutil.WriteFile(file, make([]byte, 8192), 0600); err != nil {
+		t.Fatal(err)
+	}
+	i, err := InspectRaw(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !i.Raw || i.FileSize != 8192 || i.Header != nil {
+		t.Errorf("unexpected %+v", i)
+	}
+
+	if _, err := Inspect(file); err == nil {
+		t.Error("raw image inspected as a delta")
+	}
+	if _, err := Inspect(path.Join(dir, "nonexistent")); err == nil {
+		t.Error("no error for a nonexistent file")
+	}
+}
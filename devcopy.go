@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// openDevs opens a pair of block devices of the same size,
+// the second one for writing if rw is set
+func openDevs(src, dst string, rw bool) (*os.File, *os.File, int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	flag := os.O_RDONLY
+	if rw {
+		flag = os.O_RDWR
+	}
+	out, err := os.OpenFile(dst, flag, 0)
+	if err != nil {
+		in.Close()
+		return nil, nil, 0, err
+	}
+
+	size, err := in.Seek(0, io.SeekEnd)
+	if err == nil {
+		var outSize int64
+		outSize, err = out.Seek(0, io.SeekEnd)
+		if err == nil && outSize != size {
+			err = fmt.Errorf("Device %s size %d does not match %s size %d", dst, outSize, src, size)
+		}
+	}
+	if err != nil {
+		in.Close()
+		out.Close()
+		return nil, nil, 0, err
+	}
+
+	return in, out, size, nil
+}
+
+// copyDev copies a block device contents to another one, of the
+// same size. Only the blocks that differ are written, so that
+// the destination image blocks are not allocated unnecessarily.
+func copyDev(o *op, src, dst string, blockSize uint64) error {
+	in, out, size, err := openDevs(src, dst, true)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	defer out.Close()
+
+	buf := make([]byte, blockSize)
+	old := make([]byte, blockSize)
+	for off := int64(0); off < size; off += int64(blockSize) {
+		if off%(1<<30) == 0 {
+			o.setProgress("%d%% copied", off*100/size)
+		}
+		n, err := in.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if _, err := out.ReadAt(old[:n], off); err != nil && err != io.EOF {
+			return err
+		}
+		if bytes.Equal(buf[:n], old[:n]) {
+			continue
+		}
+		if _, err := out.WriteAt(buf[:n], off); err != nil {
+			return err
+		}
+	}
+
+	return out.Sync()
+}
+
+// verifyDev makes sure two block devices have the same contents
+func verifyDev(o *op, src, dst string, blockSize uint64) error {
+	in, out, size, err := openDevs(src, dst, false)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	defer out.Close()
+
+	a := make([]byte, blockSize)
+	b := make([]byte, blockSize)
+	for off := int64(0); off < size; off += int64(blockSize) {
+		if off%(1<<30) == 0 {
+			o.setProgress("%d%% verified", off*100/size)
+		}
+		n, err := in.ReadAt(a, off)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if _, err := out.ReadAt(b[:n], off); err != nil && err != io.EOF {
+			return err
+		}
+		if !bytes.Equal(a[:n], b[:n]) {
+			return fmt.Errorf("Verification failed: %s differs from %s at offset %d", dst, src, off)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,282 @@
+// Package diskdescriptor parses and validates ploop DiskDescriptor.xml,
+// without using libploop. This makes it possible to inspect an image
+// cheaply, without opening a ploop handle (and locking the image).
+package diskdescriptor
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// SectorSize is the unit DiskDescriptor.xml sizes are in
+const SectorSize = 512
+
+// NoGUID is the parent GUID of the base delta
+const NoGUID = "{00000000-0000-0000-0000-000000000000}"
+
+// Mode is a delta file format
+type Mode string
+
+// Possible delta formats
+const (
+	// Compressed is a ploop delta (used by both expanded
+	// and preallocated images)
+	Compressed Mode = "Compressed"
+	// Plain is a raw delta
+	Plain Mode = "Plain"
+)
+
+// Image is a delta file
+type Image struct {
+	GUID string
+	Mode Mode
+	File string // absolute path
+}
+
+// Snapshot is a node in the snapshot tree. A snapshot is identified
+// by the GUID of a delta it consists of, and refers to a parent delta.
+type Snapshot struct {
+	GUID      string
+	Parent    string
+	Temporary bool
+}
+
+// Descriptor is a parsed DiskDescriptor.xml
+type Descriptor struct {
+	Version   string // format version
+	Size      uint64 // disk size, in bytes
+	BlockSize uint64 // cluster block size, in bytes
+	TopGUID   string
+	Images    []Image
+	Snapshots []Snapshot
+	// Encryption key ID, if the image is encrypted
+	EncryptionKeyID string
+}
+
+// xmlDescriptor is DiskDescriptor.xml as it is stored on disk
+type xmlDescriptor struct {
+	XMLName xml.Name `xml:"Parallels_disk_image"`
+	Version string   `xml:"Version,attr"`
+	Params  struct {
+		Size       uint64 `xml:"Disk_size"`
+		Encryption struct {
+			KeyID string `xml:"KeyId"`
+		} `xml:"Encryption"`
+	} `xml:"Disk_Parameters"`
+	Storage []struct {
+		Start     uint64 `xml:"Start"`
+		End       uint64 `xml:"End"`
+		BlockSize uint64 `xml:"Blocksize"`
+		Images    []struct {
+			GUID string `xml:"GUID"`
+			Type string `xml:"Type"`
+			File string `xml:"File"`
+		} `xml:"Image"`
+	} `xml:"StorageData>Storage"`
+	TopGUID string `xml:"Snapshots>TopGUID"`
+	Shots   []struct {
+		GUID      string    `xml:"GUID"`
+		Parent    string    `xml:"ParentGUID"`
+		Temporary *struct{} `xml:"Temporary"`
+	} `xml:"Snapshots>Shot"`
+}
+
+var guidRe = regexp.MustCompile(`^\{[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}\}$`)
+
+// Read reads, parses and validates a DiskDescriptor.xml file
+func Read(file string) (*Descriptor, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(b, path.Dir(file))
+}
+
+// Parse parses and validates DiskDescriptor.xml contents.
+// Relative delta file names are resolved against dir.
+func Parse(data []byte, dir string) (*Descriptor, error) {
+	var x xmlDescriptor
+
+	if err := xml.Unmarshal(data, &x); err != nil {
+		return nil, err
+	}
+	if len(x.Storage) != 1 {
+		return nil, fmt.Errorf("Expected 1 storage, found %d", len(x.Storage))
+	}
+	s := x.Storage[0]
+
+	d := Descriptor{
+		Version:         x.Version,
+		Size:            x.Params.Size * SectorSize,
+		BlockSize:       s.BlockSize * SectorSize,
+		TopGUID:         strings.TrimSpace(x.TopGUID),
+		EncryptionKeyID: strings.TrimSpace(x.Params.Encryption.KeyID),
+	}
+	for _, i := range s.Images {
+		f := strings.TrimSpace(i.File)
+		if f != "" && !path.IsAbs(f) {
+			f = path.Join(dir, f)
+		}
+		d.Images = append(d.Images, Image{
+			GUID: strings.TrimSpace(i.GUID),
+			Mode: Mode(strings.TrimSpace(i.Type)),
+			File: f,
+		})
+	}
+	for _, s := range x.Shots {
+		d.Snapshots = append(d.Snapshots, Snapshot{
+			GUID:      strings.TrimSpace(s.GUID),
+			Parent:    strings.TrimSpace(s.Parent),
+			Temporary: s.Temporary != nil,
+		})
+	}
+
+	if s.End != 0 && s.End != x.Params.Size {
+		return nil, fmt.Errorf("Storage end %d does not match disk size %d", s.End, x.Params.Size)
+	}
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+// Validate checks that the descriptor makes sense: sizes are set,
+// GUIDs are valid and unique, and the snapshot tree is consistent
+// with the list of images
+func (d *Descriptor) Validate() error {
+	if d.Size == 0 {
+		return fmt.Errorf("Disk size is not set")
+	}
+	if d.BlockSize == 0 || d.BlockSize&(d.BlockSize-1) != 0 {
+		return fmt.Errorf("Invalid block size %d", d.BlockSize)
+	}
+	if len(d.Images) == 0 {
+		return fmt.Errorf("No images found")
+	}
+
+	files := make(map[string]bool)
+	images := make(map[string]*Image)
+	for n := range d.Images {
+		i := &d.Images[n]
+		if !guidRe.MatchString(i.GUID) || i.GUID == NoGUID {
+			return fmt.Errorf("Invalid image GUID %q", i.GUID)
+		}
+		if images[i.GUID] != nil {
+			return fmt.Errorf("Duplicate image GUID %s", i.GUID)
+		}
+		images[i.GUID] = i
+		if i.Mode != Compressed && i.Mode != Plain {
+			return fmt.Errorf("Image %s: unknown type %q", i.GUID, i.Mode)
+		}
+		if i.File == "" {
+			return fmt.Errorf("Image %s: no file", i.GUID)
+		}
+		if files[i.File] {
+			return fmt.Errorf("Duplicate image file %s", i.File)
+		}
+		files[i.File] = true
+	}
+
+	shots := make(map[string]*Snapshot)
+	roots := 0
+	for n := range d.Snapshots {
+		s := &d.Snapshots[n]
+		if images[s.GUID] == nil {
+			return fmt.Errorf("Snapshot %s: no such image", s.GUID)
+		}
+		if shots[s.GUID] != nil {
+			return fmt.Errorf("Duplicate snapshot %s", s.GUID)
+		}
+		shots[s.GUID] = s
+		if s.Parent == NoGUID {
+			roots++
+		} else if images[s.Parent] == nil {
+			return fmt.Errorf("Snapshot %s: no such parent %s", s.GUID, s.Parent)
+		}
+	}
+	if len(shots) != len(images) {
+		return fmt.Errorf("%d image(s), but %d snapshot(s)", len(images), len(shots))
+	}
+	if roots != 1 {
+		return fmt.Errorf("Expected 1 base image, found %d", roots)
+	}
+
+	if images[d.TopGUID] == nil {
+		return fmt.Errorf("Invalid top GUID %q", d.TopGUID)
+	}
+	// Make sure there are no loops, so every chain ends at the base
+	for _, s := range d.Snapshots {
+		if _, err := d.chain(s.GUID, shots); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// chain returns GUIDs from guid down to the base image
+func (d *Descriptor) chain(guid string, shots map[string]*Snapshot) ([]string, error) {
+	var guids []string
+	for guid != NoGUID {
+		if len(guids) > len(shots) {
+			return nil, fmt.Errorf("Snapshot %s: loop in snapshot tree", guid)
+		}
+		s, ok := shots[guid]
+		if !ok {
+			return nil, fmt.Errorf("No snapshot %s", guid)
+		}
+		guids = append(guids, guid)
+		guid = s.Parent
+	}
+
+	return guids, nil
+}
+
+// Image returns an image by its GUID, or nil
+func (d *Descriptor) Image(guid string) *Image {
+	for n := range d.Images {
+		if d.Images[n].GUID == guid {
+			return &d.Images[n]
+		}
+	}
+
+	return nil
+}
+
+// Top returns the top image, i.e. the one being written to
+func (d *Descriptor) Top() *Image {
+	return d.Image(d.TopGUID)
+}
+
+// Chain returns the images the top one consists of, from the base
+// image up to the top one
+func (d *Descriptor) Chain() []Image {
+	shots := make(map[string]*Snapshot)
+	for n := range d.Snapshots {
+		shots[d.Snapshots[n].GUID] = &d.Snapshots[n]
+	}
+	guids, _ := d.chain(d.TopGUID, shots)
+
+	images := make([]Image, len(guids))
+	for n, guid := range guids {
+		images[len(guids)-1-n] = *d.Image(guid)
+	}
+
+	return images
+}
+
+// Files returns all the delta files referenced
+func (d *Descriptor) Files() []string {
+	files := make([]string, len(d.Images))
+	for n, i := range d.Images {
+		files[n] = i.File
+	}
+
+	return files
+}
@@ -0,0 +1,199 @@
+package diskdescriptor
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+const (
+	baseGUID = "{5fbaabe3-6958-40ff-92a7-860e329aab41}"
+	midGUID  = "{a1f1b0c6-3d2e-4b8a-9c4f-2e6d7a8b9c0d}"
+	topGUID  = "{0b3c5d7e-9f1a-4b2c-8d3e-4f5a6b7c8d9e}"
+)
+
+func readSample(t *testing.T, name string) string {
+	b, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		file      string
+		size      uint64
+		blockSize uint64
+		keyID     string
+		chain     []Image
+		temporary []string
+	}{
+		{
+			file:      "single.xml",
+			size:      10 << 30,
+			blockSize: 1 << 20,
+			chain: []Image{
+				{GUID: baseGUID, Mode: Compressed, File: "/vol/root.hdd"},
+			},
+		},
+		{
+			file:      "snapshots.xml",
+			size:      1 << 30,
+			blockSize: 64 << 10,
+			chain: []Image{
+				{GUID: baseGUID, Mode: Compressed, File: "/vol/root.hdd"},
+				{GUID: midGUID, Mode: Compressed, File: "/vol/root.hdd." + midGUID},
+				{GUID: topGUID, Mode: Compressed, File: "/vz/other/root.hdd." + topGUID},
+			},
+			temporary: []string{midGUID},
+		},
+		{
+			file:      "encrypted.xml",
+			size:      1 << 30,
+			blockSize: 1 << 20,
+			keyID:     "8d0e5c1c-3c65-4e6a-a5b0-6d1d5b3f0f2a",
+			chain: []Image{
+				{GUID: baseGUID, Mode: Plain, File: "/vol/root.hdd"},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		d, err := Parse([]byte(readSample(t, tc.file)), "/vol")
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.file, err)
+			continue
+		}
+		if d.Size != tc.size {
+			t.Errorf("%s: size %d, expected %d", tc.file, d.Size, tc.size)
+		}
+		if d.BlockSize != tc.blockSize {
+			t.Errorf("%s: block size %d, expected %d", tc.file, d.BlockSize, tc.blockSize)
+		}
+		if d.EncryptionKeyID != tc.keyID {
+			t.Errorf("%s: key ID %q, expected %q", tc.file, d.EncryptionKeyID, tc.keyID)
+		}
+		top := tc.chain[len(tc.chain)-1]
+		if d.Top() == nil || *d.Top() != top {
+			t.Errorf("%s: top %+v, expected %+v", tc.file, d.Top(), top)
+		}
+
+		chain := d.Chain()
+		if len(chain) != len(tc.chain) {
+			t.Errorf("%s: chain %+v, expected %+v", tc.file, chain, tc.chain)
+			continue
+		}
+		for n := range chain {
+			if chain[n] != tc.chain[n] {
+				t.Errorf("%s: chain[%d] %+v, expected %+v", tc.file, n, chain[n], tc.chain[n])
+			}
+		}
+		if len(d.Files()) != len(tc.chain) {
+			t.Errorf("%s: files %v, expected %d", tc.file, d.Files(), len(tc.chain))
+		}
+
+		temp := make(map[string]bool)
+		for _, guid := range tc.temporary {
+			temp[guid] = true
+		}
+		for _, s := range d.Snapshots {
+			if s.Temporary != temp[s.GUID] {
+				t.Errorf("%s: snapshot %s temporary %v", tc.file, s.GUID, s.Temporary)
+			}
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	d, err := Read("testdata/single.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := d.Top().File; f != "testdata/root.hdd" {
+		t.Errorf("top file %s, expected testdata/root.hdd", f)
+	}
+
+	if _, err := Read("testdata/nonexistent.xml"); err == nil {
+		t.Error("no error reading a nonexistent file")
+	}
+}
+
+// shot returns a snapshot tree entry as it is in snapshots.xml
+func shot(guid, parent string) string {
+	return "<GUID>" + guid + "</GUID>\n      <ParentGUID>" + parent + "</ParentGUID>"
+}
+
+func TestParseMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		old  string // replace all old with new in file contents
+		new  string
+		err  string // expected error substring
+	}{
+		{"truncated", "single.xml", "</Parallels_disk_image>", "", "unexpected EOF"},
+		{"unexpected root", "single.xml", "Parallels_disk_image", "Disk", "expected element type"},
+		{"no storage", "single.xml", "Storage>", "Disk>", "Expected 1 storage, found 0"},
+		{"end mismatch", "single.xml", "<End>20971520</End>", "<End>2048</End>", "Storage end 2048 does not match"},
+		{"no size", "single.xml", "20971520<", "0<", "Disk size is not set"},
+		{"no block size", "single.xml", "<Blocksize>2048</Blocksize>", "", "Invalid block size 0"},
+		{"bad block size", "single.xml", "<Blocksize>2048</Blocksize>", "<Blocksize>2000</Blocksize>", "Invalid block size"},
+		{"no images", "single.xml", "Image>", "Disk>", "No images found"},
+		{"bad guid", "single.xml", "<GUID>" + baseGUID + "</GUID>\n        <Type>", "<GUID>5fbaabe3</GUID>\n        <Type>", "Invalid image GUID"},
+		{"zero guid", "single.xml", "<GUID>" + baseGUID + "</GUID>\n        <Type>", "<GUID>" + NoGUID + "</GUID>\n        <Type>", "Invalid image GUID"},
+		{"unknown type", "single.xml", "<Type>Compressed</Type>", "<Type>Qcow2</Type>", "unknown type"},
+		{"no file", "single.xml", "<File>root.hdd</File>", "<File> </File>", "no file"},
+		{"duplicate guid", "snapshots.xml", "<GUID>" + midGUID + "</GUID>\n        <Type>", "<GUID>" + baseGUID + "</GUID>\n        <Type>", "Duplicate image GUID"},
+		{"duplicate file", "snapshots.xml", "<File>root.hdd.{a1f1b0c6-3d2e-4b8a-9c4f-2e6d7a8b9c0d}</File>", "<File>/vol/root.hdd</File>", "Duplicate image file"},
+		{"missing snapshot", "snapshots.xml", "<Shot>\n      " + shot(midGUID, baseGUID) + "\n      <Temporary/>\n    </Shot>", "", "3 image(s), but 2 snapshot(s)"},
+		{"snapshot of no image", "snapshots.xml", shot(midGUID, baseGUID), shot("{11111111-2222-3333-4444-555555555555}", baseGUID), "no such image"},
+		{"duplicate snapshot", "snapshots.xml", shot(midGUID, baseGUID), shot(baseGUID, NoGUID), "Duplicate snapshot"},
+		{"no parent", "snapshots.xml", shot(topGUID, midGUID), shot(topGUID, "{11111111-2222-3333-4444-555555555555}"), "no such parent"},
+		{"two bases", "snapshots.xml", shot(midGUID, baseGUID), shot(midGUID, NoGUID), "Expected 1 base image, found 2"},
+		{"no base", "single.xml", "<ParentGUID>" + NoGUID, "<ParentGUID>" + baseGUID, "Expected 1 base image, found 0"},
+		{"loop", "snapshots.xml", shot(midGUID, baseGUID), shot(midGUID, topGUID), "loop in snapshot tree"},
+		{"bad top", "snapshots.xml", "<TopGUID>" + topGUID, "<TopGUID>{11111111-2222-3333-4444-555555555555}", "Invalid top GUID"},
+		{"no top", "snapshots.xml", "<TopGUID>" + topGUID + "</TopGUID>", "", "Invalid top GUID"},
+	}
+
+	for _, tc := range tests {
+		data := readSample(t, tc.file)
+		if !strings.Contains(data, tc.old) {
+			t.Fatalf("%s: %q not found in %s", tc.name, tc.old, tc.file)
+		}
+		data = strings.Replace(data, tc.old, tc.new, -1)
+
+		_, err := Parse([]byte(data), "/vol")
+		if err == nil {
+			t.Errorf("%s: no error", tc.name)
+		} else if !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: error %q, expected %q", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	d, err := Parse([]byte(readSample(t, "snapshots.xml")), "/vol")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a descriptor modified in memory is validated as well
+	d.Images[1].File = "/elsewhere/delta"
+	if err := d.Validate(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if d.Image(midGUID).File != "/elsewhere/delta" {
+		t.Errorf("image %s not found", midGUID)
+	}
+	if d.Image("{11111111-2222-3333-4444-555555555555}") != nil {
+		t.Error("nonexistent image found")
+	}
+
+	d.Snapshots[0].Parent = topGUID
+	if err := d.Validate(); err == nil {
+		t.Error("no error for a loop through the base image")
+	}
+}
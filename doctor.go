@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Severity levels of doctor findings
+const (
+	findingOK      = "ok"
+	findingWarning = "warning"
+	findingError   = "error"
+)
+
+// Thresholds for free space checks, in percent
+const (
+	minFreeSpace  = 10
+	minFreeInodes = 10
+)
+
+// Kernel modules required to use ploop
+var ploopModules = []string{"ploop", "pfmt_ploop1", "pio_direct"}
+
+// finding is a result of a single doctor check
+type finding struct {
+	Check   string
+	Status  string
+	Message string
+	Hint    string `json:",omitempty"` // what to do about it
+}
+
+type findings []finding
+
+func (f *findings) add(check, status, msg, hint string) {
+	*f = append(*f, finding{Check: check, Status: status, Message: msg, Hint: hint})
+}
+
+// doctor runs a number of checks to find out what might prevent
+// the plugin from working properly
+func (d *ploopDriver) doctor() findings {
+	var f findings
+
+	d.checkModules(&f)
+	d.checkPloopTool(&f)
+	if d.checkHome(&f) {
+		d.checkFreeSpace(&f)
+		d.checkVstorage(&f)
+		d.checkMounts(&f)
+		d.checkVolumes(&f)
+	}
+
+	return f
+}
+
+func (d *ploopDriver) checkModules(f *findings) {
+	var missing []string
+	for _, m := range ploopModules {
+		if _, err := os.Stat(path.Join("/sys/module", m)); err != nil {
+			missing = append(missing, m)
+		}
+	}
+
+	if len(missing) == 0 {
+		f.add("kernel", findingOK, "ploop kernel modules are loaded", "")
+		return
+	}
+	f.add("kernel", findingError,
+		fmt.Sprintf("ploop kernel modules are not loaded: %s", strings.Join(missing, ", ")),
+		"Run modprobe for the modules listed; make sure you are running a Virtuozzo or OpenVZ kernel")
+}
+
+// checkPloopTool reports the version of ploop command line tool, used
+// for the functionality not available from goploop. It should match
+// the libploop the plugin is linked with, but that one has no way to
+// report its version, so it's not checked.
+func (d *ploopDriver) checkPloopTool(f *findings) {
+	out, err := exec.Command("ploop", "--version").CombinedOutput()
+	if err != nil {
+		f.add("ploop tool", findingWarning,
+			fmt.Sprintf("Can't get ploop tool version: %s", err),
+			"Install ploop package of the same version as ploop-lib the plugin is using")
+		return
+	}
+
+	ver := strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+	f.add("ploop tool", findingOK, fmt.Sprintf("%s (libploop version is not checked)", ver), "")
+}
+
+// checkHome checks that home exists and is usable.
+// Returns false if there is no point in further checks.
+func (d *ploopDriver) checkHome(f *findings) bool {
+	fi, err := os.Stat(d.home)
+	if err != nil {
+		f.add("home", findingError, err.Error(), "Create the directory, or set the right one using -home")
+		return false
+	}
+	if !fi.IsDir() {
+		f.add("home", findingError, fmt.Sprintf("%s is not a directory", d.home), "Set the right home using -home")
+		return false
+	}
+
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Uid != 0 {
+		f.add("home", findingWarning,
+			fmt.Sprintf("%s is owned by uid %d, not root", d.home, st.Uid),
+			"Run chown root "+d.home)
+	}
+	if fi.Mode().Perm()&0022 != 0 {
+		f.add("home", findingWarning,
+			fmt.Sprintf("%s is writable by group or others (mode %s)", d.home, fi.Mode().Perm()),
+			"Run chmod go-w "+d.home)
+	}
+
+	tmp, err := ioutil.TempFile(d.home, ".doctor-")
+	if err != nil {
+		f.add("home", findingError, fmt.Sprintf("%s is not writable: %s", d.home, err),
+			"Check the directory permissions, and that the filesystem is not read-only")
+		return false
+	}
+	tmp.Close()
+	os.Remove(tmp.Name())
+
+	fs, err := GetFilesystemType(d.home)
+	switch {
+	case err != nil:
+		f.add("home", findingWarning, fmt.Sprintf("Can't get %s filesystem type: %s", d.home, err), "")
+	case fs == "ext4" || fs == "xfs" || fs == "fuse.vstorage" || strings.HasPrefix(fs, "nfs"):
+		f.add("home", findingOK, fmt.Sprintf("%s is on %s", d.home, fs), "")
+	default:
+		f.add("home", findingWarning,
+			fmt.Sprintf("%s is on %s, which might not be suitable for ploop images", d.home, fs),
+			"Use a home on ext4, xfs, NFS or Virtuozzo Storage")
+	}
+
+	return true
+}
+
+func (d *ploopDriver) checkFreeSpace(f *findings) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(d.home, &st); err != nil {
+		f.add("space", findingWarning, fmt.Sprintf("Can't get free space: %s", err), "")
+		return
+	}
+
+	if st.Blocks > 0 {
+		free := st.Bavail * 100 / st.Blocks
+		msg := fmt.Sprintf("%d%% of space is free (%d MB)", free, st.Bavail*uint64(st.Bsize)>>20)
+		if free < minFreeSpace {
+			f.add("space", findingWarning, msg, "Free up some space; note expanded images grow as they are used")
+		} else {
+			f.add("space", findingOK, msg, "")
+		}
+	}
+	if st.Files > 0 {
+		free := st.Ffree * 100 / st.Files
+		msg := fmt.Sprintf("%d%% of inodes are free", free)
+		if free < minFreeInodes {
+			f.add("inodes", findingWarning, msg, "Remove unneeded files from the filesystem")
+		} else {
+			f.add("inodes", findingOK, msg, "")
+		}
+	}
+}
+
+func (d *ploopDriver) checkVstorage(f *findings) {
+	if !isOnVstorage(d.home) {
+		return
+	}
+
+	if _, err := exec.LookPath("vstorage"); err != nil {
+		f.add("vstorage", findingWarning, "vstorage tool is not found",
+			"Install vstorage-ctl package; it is needed to set storage tiers")
+		return
+	}
+
+	src, err := GetFilesystemSource(d.home)
+	if err != nil {
+		f.add("vstorage", findingWarning, fmt.Sprintf("Can't get vstorage cluster name: %s", err), "")
+		return
+	}
+	cluster := strings.TrimPrefix(src, "vstorage://")
+
+	var out string
+	err = withTimeout(30*time.Second, func() (err error) {
+		out, err = vstorageOut("-c", cluster, "stat")
+		return err
+	})
+	if err != nil {
+		f.add("vstorage", findingError, fmt.Sprintf("Cluster %s: %s", cluster, err),
+			"Check the cluster state using vstorage -c "+cluster+" top")
+		return
+	}
+	status := strings.TrimSpace(strings.SplitN(out, "\n", 2)[0])
+	f.add("vstorage", findingOK, fmt.Sprintf("Cluster %s: %s", cluster, status), "")
+}
+
+func (d *ploopDriver) checkMounts(f *findings) {
+	names, err := d.mountedVolumes()
+	if err != nil {
+		f.add("mounts", findingWarning, fmt.Sprintf("Can't get mounted volumes: %s", err), "")
+		return
+	}
+
+	stale := 0
+	for _, name := range names {
+		mnt := d.mnt(name)
+		if exist, _ := d.volExist(name); !exist {
+			stale++
+			f.add("mounts", findingWarning,
+				fmt.Sprintf("%s is mounted, but volume %s does not exist", mnt, name),
+				"Run umount "+mnt)
+			continue
+		}
+		if _, err := ioutil.ReadDir(mnt); err != nil {
+			stale++
+			f.add("mounts", findingError,
+				fmt.Sprintf("Volume %s mount %s is not accessible: %s", name, mnt, err),
+				"Run ploop umount "+d.dd(name)+", then ploop check it")
+		}
+	}
+
+	if stale == 0 {
+		f.add("mounts", findingOK, fmt.Sprintf("%d volume(s) mounted, no stale mounts", len(names)), "")
+	}
+}
+
+func (d *ploopDriver) checkVolumes(f *findings) {
+	list, err := d.brokenVolumes()
+	if err != nil {
+		f.add("volumes", findingWarning, fmt.Sprintf("Can't list volumes: %s", err), "")
+		return
+	}
+
+	for _, b := range list {
+		f.add("volumes", findingError, fmt.Sprintf("Volume %s is broken: %s", b.Volume, b.Reason),
+			"Run docker-volume-ploop check "+b.Volume+", or quarantine it")
+	}
+	if len(list) == 0 {
+		f.add("volumes", findingOK, "No broken volumes", "")
+	}
+}
+
+// adminDoctor runs doctor checks from within the plugin
+func (d *ploopDriver) adminDoctor(r *http.Request) (interface{}, error) {
+	return d.doctor(), nil
+}
+
+// printFindings prints doctor findings in a human readable form.
+// Returns true if there are no errors.
+func printFindings(list findings) bool {
+	ok := true
+	for _, f := range list {
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "[%-7s] %-9s %s", strings.ToUpper(f.Status), f.Check, f.Message)
+		if f.Hint != "" {
+			fmt.Fprintf(&buf, "\n%20s%s", "", f.Hint)
+		}
+		fmt.Println(buf.String())
+		if f.Status == findingError {
+			ok = false
+		}
+	}
+
+	return ok
+}
+
+func cmdDoctor(args []string) error {
+	var list findings
+
+	switch {
+	case len(args) == 0:
+		// run locally, the plugin might not be running
+		d := ploopDriver{home: *home}
+		list = d.doctor()
+	case len(args) == 1 && args[0] == "-plugin":
+		if err := adminCall("GET", "/doctor", nil, &list); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Usage: doctor [-plugin]")
+	}
+
+	if !printFindings(list) {
+		return fmt.Errorf("Problems found")
+	}
+	return nil
+}
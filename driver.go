@@ -5,11 +5,14 @@ import (
 	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/docker/go-units"
+	"github.com/kolyshkin/docker-volume-ploop/diskdescriptor"
 	"github.com/kolyshkin/goploop"
 )
 
@@ -21,11 +24,26 @@ import (
  *   - ploop format (expanded/preallocated/raw)
  *   - cluster block log size in 512-byte sectors,
  *     (values are from 6 to 15, default is 11: 2^11 * 512 = 1 MB)
+ *   - fsck policy on mount (always/auto/never)
+ *   - compaction interval (0 to disable)
+ *   - mount options
+ *   - Docker userns-remap user
+ *   - SELinux labelling (none/shared/private)
+ *   - secure delete mode (off/overwrite/discard)
  *
  * Volume options (for description see above):
  * - size (optional)
  * - format
  * - cluster block size
+ * - fsck policy
+ * - compaction interval
+ * - mount options, and whether to mount read-only
+ * - user and group quotas (on/off)
+ * - root directory owner and permissions (see owner.go)
+ * - SELinux labelling
+ * - encryption (see crypt.go)
+ * - secure delete mode (see erase.go)
+ * - inner filesystem type and mkfs options (see mkfs.go)
  */
 
 type volumeOptions struct {
@@ -34,18 +52,48 @@ type volumeOptions struct {
 	clog  uint            // cluster block log size in 512-byte sectors
 	tier  int8            // Virtuozzo storage tier (-1: use default)
 	scope string          // Volume scope (global/local/auto)
+	fsck  string          // fsck policy on mount (always/auto/never)
+	// how often to compact the image (0: never)
+	compact time.Duration
+	// mount options (see mountopts.go)
+	mountOpts string
+	readonly  bool // mount read-only
+	quota     bool // enable user and group quotas
+	// dockerd --userns-remap value, to shift root owner IDs
+	usernsRemap string
+	selinux     string // SELinux labelling mode (see selinux.go)
+	encrypt     bool   // encrypt the volume
+	// how to erase volume data on removal
+	secureDelete string
+}
+
+// Driver-wide options
+type driverOptions struct {
+	maxHeavy int           // max number of expensive operations in parallel
+	timeout  time.Duration // operation timeout (0: no timeout)
+	ionice   string        // I/O priority of background operations
+	keys     keyProvider   // encryption key provider (nil: none)
 }
 
 type mount struct {
-	count  int32
-	device string
+	ids     map[string]bool // mount IDs of containers using the volume
+	adopted bool            // mounted by a previous plugin instance, users unknown
 }
 
 type ploopDriver struct {
 	home    string
 	opts    volumeOptions
+	dopts   driverOptions
 	mountsM sync.RWMutex
 	mounts  map[string]*mount
+	locks   volLocks      // per-volume locks
+	heavy   chan struct{} // semaphore limiting expensive operations
+	deltas  deltaCache    // delta inspection results, for volume status
+
+	stateM   sync.Mutex
+	draining bool           // reject new creates and mounts
+	stopping bool           // reject everything, we're shutting down
+	running  sync.WaitGroup // operations in progress
 }
 
 func (o *volumeOptions) setSize(str string) error {
@@ -94,7 +142,98 @@ func (o *volumeOptions) setScope(str string) error {
 	return nil
 }
 
-func newPloopDriver(home string, opts *volumeOptions) *ploopDriver {
+func (o *volumeOptions) setFsck(str string) error {
+	switch str {
+	case fsckAlways, fsckAuto, fsckNever:
+	default:
+		return fmt.Errorf("Can't parse fsck %s (use always, auto or never)", str)
+	}
+
+	o.fsck = str
+	return nil
+}
+
+func (o *volumeOptions) setCompact(str string) error {
+	interval, err := time.ParseDuration(str)
+	if err != nil || interval < 0 {
+		return fmt.Errorf("Can't parse compact %s (use an interval like 24h, or 0)", str)
+	}
+
+	o.compact = interval
+	return nil
+}
+
+func (o *volumeOptions) setMountOpts(str string) error {
+	// the filesystem is checked on volume creation
+	if _, err := parseMountOpts(str, "", false); err != nil {
+		return err
+	}
+
+	o.mountOpts = str
+	return nil
+}
+
+func (o *volumeOptions) setReadonly(str string) error {
+	ro, err := strconv.ParseBool(str)
+	if err != nil {
+		return fmt.Errorf("Can't parse readonly %s: %s", str, err)
+	}
+
+	o.readonly = ro
+	return nil
+}
+
+func (o *volumeOptions) setUsernsRemap(str string) error {
+	if _, _, err := remapNames(str); err != nil {
+		return err
+	}
+
+	o.usernsRemap = str
+	return nil
+}
+
+func (o *volumeOptions) setSELinux(str string) error {
+	if err := checkSELinuxMode(str); err != nil {
+		return err
+	}
+
+	o.selinux = str
+	return nil
+}
+
+func (o *volumeOptions) setEncrypt(str string) error {
+	enc, err := strconv.ParseBool(str)
+	if err != nil {
+		return fmt.Errorf("Can't parse encrypt %s: %s", str, err)
+	}
+
+	o.encrypt = enc
+	return nil
+}
+
+func (o *volumeOptions) setSecureDelete(str string) error {
+	if err := checkEraseMode(str); err != nil {
+		return err
+	}
+
+	o.secureDelete = str
+	return nil
+}
+
+func (o *volumeOptions) setQuota(str string) error {
+	switch str {
+	case "on":
+		o.quota = true
+	case "off":
+		o.quota = false
+	default:
+		return fmt.Errorf("Can't parse quota %s (use on or off)", str)
+	}
+
+	return nil
+}
+
+func newPloopDriver(home string, opts *volumeOptions, dopts *driverOptions) *ploopDriver {
 	// home must exist
 	_, err := os.Stat(home)
 	if err != nil {
@@ -118,11 +257,13 @@ func newPloopDriver(home string, opts *volumeOptions) *ploopDriver {
 	d := ploopDriver{
 		home:   home,
 		opts:   *opts,
+		dopts:  *dopts,
 		mounts: make(map[string]*mount),
+		heavy:  make(chan struct{}, dopts.maxHeavy),
 	}
 
 	// Make sure to create base paths we'll use
-	err = os.MkdirAll(d.img(""), 0700)
+	err = os.MkdirAll(d.dir(""), 0700)
 	if err != nil {
 		logrus.Fatalf("Error %s", err)
 	}
@@ -130,201 +271,501 @@ func newPloopDriver(home string, opts *volumeOptions) *ploopDriver {
 	if err != nil {
 		logrus.Fatalf("Error %s", err)
 	}
+	err = os.MkdirAll(d.journal(""), 0700)
+	if err != nil {
+		logrus.Fatalf("Error %s", err)
+	}
+
+	// Deal with operations interrupted by a crash
+	d.journalRecover()
+	// Find out what's left mounted
+	d.adoptMounts()
 
 	return &d
 }
 
 func (d *ploopDriver) Create(r volume.Request) volume.Response {
+	o := newOp("create", r.Name)
+	err := d.run(o, r.Options, func() error {
+		return d.create(o, r.Name, r.Options)
+	}, nil)
+
+	return errResponse(err)
+}
+
+func (d *ploopDriver) create(o *op, name string, opts map[string]string) (err error) {
+	if err := checkVolName(name); err != nil {
+		return err
+	}
+
 	// check if it already exists
-	dd := d.dd(r.Name)
-	_, err := os.Stat(dd)
+	dd := d.dd(name)
+	_, err = os.Stat(dd)
 	if err == nil {
-		// volume already exists
-		return volume.Response{}
+		// volume already exists, make sure it's usable
+		return d.checkBroken(o, name)
 	}
 	if !os.IsNotExist(err) {
-		logrus.Errorf("Unexpected error from stat(): %s", err)
-		return volume.Response{Err: err.Error()}
+		return fmt.Errorf("Unexpected error from stat(): %s", err)
+	}
+	if d.lostDD(name) {
+		return d.checkBroken(o, name)
 	}
 
 	// Parse options
-	o := d.opts
+	v := d.opts
+
+	if val, ok := opts["size"]; ok {
+		if err := v.setSize(val); err != nil {
+			return err
+		}
+	}
+
+	if val, ok := opts["mode"]; ok {
+		if err := v.setMode(val); err != nil {
+			return err
+		}
+	}
+
+	if val, ok := opts["clog"]; ok {
+		if err := v.setCLog(val); err != nil {
+			return err
+		}
+	}
+
+	if val, ok := opts["tier"]; ok {
+		if err := v.setTier(val); err != nil {
+			return err
+		}
+	}
+
+	// Volume settings to be saved
+	meta := volumeMeta{ImageMode: strings.ToLower(v.mode.String())}
+
+	if val, ok := opts["fsck"]; ok {
+		if err := v.setFsck(val); err != nil {
+			return err
+		}
+		meta.Fsck = v.fsck
+	}
+
+	if val, ok := opts["compact"]; ok {
+		if err := v.setCompact(val); err != nil {
+			return err
+		}
+		meta.Compact = val
+	}
+
+	mkfs, err := parseMkfsOptions(opts)
+	if err != nil {
+		return err
+	}
+	if len(mkfs.given) > 0 {
+		meta.FSType = mkfs.fstype
+		meta.Mkfs = mkfs.given
+	}
+
+	if val, ok := opts["mount-opts"]; ok {
+		if _, err := parseMountOpts(val, mkfs.fstype, true); err != nil {
+			return err
+		}
+		meta.MountOpts = val
+	}
+
+	if val, ok := opts["readonly"]; ok {
+		if err := v.setReadonly(val); err != nil {
+			return err
+		}
+		meta.Readonly = v.readonly
+	}
 
-	if val, ok := r.Options["size"]; ok {
-		err := o.setSize(val)
-		if err != nil {
-			logrus.Errorf(err.Error())
-			return volume.Response{Err: err.Error()}
+	if val, ok := opts["quota"]; ok {
+		if err := v.setQuota(val); err != nil {
+			return err
 		}
+		meta.Quota = v.quota
+	}
+
+	owner, err := parseOwner(opts)
+	if err != nil {
+		return err
+	}
+	if _, ok := opts["userns-remap"]; !ok {
+		owner.usernsRemap = v.usernsRemap
 	}
 
-	if val, ok := r.Options["mode"]; ok {
-		err := o.setMode(val)
-		if err != nil {
-			logrus.Errorf(err.Error())
-			return volume.Response{Err: err.Error()}
+	if val, ok := opts["selinux"]; ok {
+		if err := v.setSELinux(val); err != nil {
+			return err
+		}
+		if v.selinux != selinuxNone && !selinuxEnabled() {
+			return fmt.Errorf("Can't use selinux %s: SELinux is not enabled", v.selinux)
+		}
+	}
+	if v.selinux != selinuxNone && selinuxEnabled() {
+		if meta.SELinuxLabel, err = selinuxLabel(v.selinux); err != nil {
+			return err
 		}
 	}
 
-	if val, ok := r.Options["clog"]; ok {
-		err := o.setCLog(val)
-		if err != nil {
-			logrus.Errorf(err.Error())
-			return volume.Response{Err: err.Error()}
+	if val, ok := opts["encrypt"]; ok {
+		if err := v.setEncrypt(val); err != nil {
+			return err
+		}
+		if v.encrypt {
+			if err := d.checkCrypt(); err != nil {
+				return err
+			}
 		}
 	}
 
-	if val, ok := r.Options["tier"]; ok {
-		err := o.setTier(val)
-		if err != nil {
-			logrus.Errorf(err.Error())
-			return volume.Response{Err: err.Error()}
+	if val, ok := opts["secure-delete"]; ok {
+		if err := v.setSecureDelete(val); err != nil {
+			return err
 		}
+		meta.SecureDelete = val
 	}
 
-	logrus.Debugf("Creating volume %s", r.Name)
-	// Create containing directory
-	dir := d.dir(r.Name)
+	o.log.Debugf("Creating volume")
+	j, err := d.journalBegin(o, nil)
+	if err != nil {
+		return err
+	}
+	defer d.journalDone(j, &err)
+
+	// Create containing directory. The step is recorded first,
+	// so recovery knows the directory might be ours.
+	if err := d.journalStep(j, "mkdir"); err != nil {
+		return err
+	}
+	dir := d.dir(name)
 	err = os.Mkdir(dir, 0700)
 	if err != nil {
-		return volume.Response{Err: err.Error()}
+		return err
 	}
 
 	// set storage tier
-	if err := vstorageSetTier(dir, o.tier); err != nil {
-		logrus.Warnf("Can't set tier %d: %s", o.tier, err)
+	if err := vstorageSetTier(dir, v.tier); err != nil {
+		o.log.Warnf("Can't set tier %d: %s", v.tier, err)
 	}
 
 	// Create an image
-	file := d.img(r.Name)
-	cp := ploop.CreateParam{Size: o.size, Mode: o.mode, File: file, CLog: o.clog, Flags: ploop.NoLazy}
+	file := d.img(name)
+	cp := ploop.CreateParam{Size: v.size, Mode: v.mode, File: file, CLog: v.clog, Flags: ploop.NoLazy}
 
+	if v.mode == ploop.Preallocated {
+		// allocating all the image blocks takes a while
+		defer d.heavyOp(o)()
+	}
 	if err := ploop.Create(&cp); err != nil {
-		logrus.Errorf("Can't create ploop image: %s", err)
 		os.RemoveAll(dir)
-		return volume.Response{Err: err.Error()}
+		return err
+	}
+
+	if v.encrypt {
+		if meta.KeyID, err = d.encrypt(o, name, mkfs); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+	} else if len(mkfs.args) > 0 {
+		if err := d.mkfs(o, name, mkfs); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+	}
+
+	if owner.isSet() {
+		if err := d.applyOwner(o, name, &meta, owner); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+		meta.setOwner(owner)
+	}
+
+	if err := d.saveMeta(name, &meta); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	// Make sure the volume is on disk before its journal record is gone
+	if err := syncDir(dir); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	if err := syncDir(d.dir("")); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	if err := d.journalStep(j, "done"); err != nil {
+		os.RemoveAll(dir)
+		return err
 	}
 
 	// all went well
-	return volume.Response{}
+	return nil
 }
 
 func (d *ploopDriver) Remove(r volume.Request) volume.Response {
-	logrus.Debugf("Removing volume %s", r.Name)
+	o := newOp("remove", r.Name)
+	err := d.run(o, nil, func() error {
+		return d.remove(o, r.Name)
+	}, nil)
+
+	return errResponse(err)
+}
+
+func (d *ploopDriver) remove(o *op, name string) (err error) {
+	o.log.Debugf("Removing volume")
+
+	if err := d.checkBroken(o, name); err != nil {
+		return err
+	}
 
 	/* The ploop image to be removed might be mounted.
 	 * The question is, what is the more correct thing to do:
 	 * 1. Auto-unmount and proceed
 	 * 2. Reject removing mounted image
 	 */
-	p, err := ploop.Open(d.dd(r.Name))
+	p, err := ploop.Open(d.dd(name))
 	if err == nil {
-		if m, _ := p.IsMounted(); m {
-			//err := fmt.Error("Rejecting to remove mounted image %s\n", r.Name)
-			logrus.Error(err)
-			return volume.Response{Err: err.Error()}
+		m, _ := p.IsMounted()
+		p.Close()
+		if m {
+			return fmt.Errorf("Rejecting to remove mounted volume %s", name)
 			/*
 				err = p.Umount()
 				if err != nil && !ploop.IsNotMounted(err) {
-					logrus.Errorf("Can't umount %s: %s", r.Name, err)
-					return volume.Response{Err: err.Error()}
+					return err
 				}
 			*/
 		}
-		p.Close()
 	}
 
 	// Proceed with removal
-	err = os.RemoveAll(d.dir(r.Name))
+	mode := d.eraseMode(name)
+	var args map[string]string
+	if mode != eraseOff {
+		args = map[string]string{"erase": mode}
+	}
+	j, err := d.journalBegin(o, args)
 	if err != nil {
-		logrus.Error(err)
-		return volume.Response{Err: err.Error()}
+		return err
 	}
+	defer d.journalDone(j, &err)
 
-	// all went well
-	return volume.Response{}
+	if mode == eraseOff {
+		return os.RemoveAll(d.dir(name))
+	}
+
+	dir, err := d.moveToErase(name, mode)
+	if err != nil {
+		return err
+	}
+	d.startErase(dir)
+
+	return nil
 }
 
 func (d *ploopDriver) Mount(r volume.MountRequest) volume.Response {
-	logrus.Debugf("Mounting volume %s", r.Name)
+	var mnt string
+
+	o := newOpID("mount", r.Name, r.ID)
+	err := d.run(o, nil, func() (err error) {
+		if d.isMounted(r.Name) {
+			// already mounted for another container
+			o.log.Debugf("Volume is already mounted")
+			mnt = d.mnt(r.Name)
+		} else if mnt, err = d.mount(o, r.Name); err != nil {
+			return err
+		}
+		d.addConsumer(r.Name, r.ID)
+		return nil
+	}, func() {
+		// Docker thinks mount has failed, so it won't unmount
+		d.release(o, r.Name, r.ID)
+	})
+	if err != nil {
+		return errResponse(err)
+	}
+
+	return volume.Response{Mountpoint: mnt}
+}
+
+func (d *ploopDriver) mount(o *op, name string) (string, error) {
+	o.log.Debugf("Mounting volume")
 
-	p, err := ploop.Open(d.dd(r.Name))
+	if err := d.checkBroken(o, name); err != nil {
+		return "", err
+	}
+
+	p, err := ploop.Open(d.dd(name))
 	if err != nil {
-		logrus.Errorf("Can't open ploop: %s", err)
-		return volume.Response{Err: err.Error()}
+		return "", err
 	}
 	defer p.Close()
 
-	mnt := d.mnt(r.Name)
+	mnt := d.mnt(name)
 	err = os.Mkdir(mnt, 0700)
 	if err != nil && !os.IsExist(err) {
-		logrus.Errorf("Error %s", err)
-		return volume.Response{Err: err.Error()}
+		return "", err
 	}
 
-	mp := ploop.MountParam{Target: mnt}
+	meta, err := d.loadMeta(name)
+	if err != nil {
+		return "", err
+	}
 
-	dev, err := p.Mount(&mp)
+	opts := d.opts.mountOpts
+	if meta.MountOpts != "" {
+		opts = meta.MountOpts
+	}
+	// driver defaults might not suit every filesystem
+	mo, err := parseMountOpts(opts, volumeFSType(meta), meta.MountOpts != "")
 	if err != nil {
-		logrus.Errorf("Can't mount ploop: %s", err)
-		return volume.Response{Err: err.Error()}
+		return "", err
+	}
+
+	mp := ploop.MountParam{
+		Target:   mnt,
+		Flags:    mo.flags,
+		Data:     mo.data,
+		Readonly: meta.Readonly,
+		Fsck:     d.needFsck(name, meta),
+	}
+	if meta.Quota {
+		if volumeFSType(meta) == fsXFS {
+			mp.Data = addMountData(mp.Data, "uquota,gquota")
+		} else {
+			mp.Quota = true
+		}
+	}
+	if meta.SELinuxLabel != "" {
+		if selinuxEnabled() {
+			mp.Data = addMountData(mp.Data, selinuxMountData(meta.SELinuxLabel))
+		} else {
+			o.log.Warnf("SELinux is not enabled, not using label %s", meta.SELinuxLabel)
+		}
+	}
+	if mp.Fsck {
+		o.log.Infof("Checking inner filesystem")
+	}
+
+	dev, err := d.mountFS(o, p, name, meta, &mp)
+	if err != nil {
+		if meta.SELinuxLabel != "" && selinuxEnabled() {
+			return "", fmt.Errorf("Can't mount with SELinux label %s: %s", meta.SELinuxLabel, err)
+		}
+		return "", err
+	}
+	o.log.Debugf("Mounted to %s (dev=%s)", mnt, dev)
+
+	if mp.Quota && !mp.Readonly {
+		if err := d.quotaOn(o, mnt); err != nil {
+			d.umountFS(o, p, name, meta)
+			return "", fmt.Errorf("Can't enable quota: %s", err)
+		}
+	}
+
+	// Mark the volume as in use, so we know if it's not
+	// cleanly unmounted. Failing that is not fatal.
+	if err := ioutil.WriteFile(d.dirtyMark(name), nil, 0600); err != nil {
+		o.log.Warnf("Can't create %s: %s", d.dirtyMark(name), err)
 	}
-	logrus.Debugf("Mounted %s to %s (dev=%s)", r.Name, d.mnt(r.Name), dev)
 
 	// all went well
-	return volume.Response{Mountpoint: mnt}
+	return mnt, nil
 }
 
 func (d *ploopDriver) Unmount(r volume.UnmountRequest) volume.Response {
-	logrus.Debugf("Unmounting volume %s", r.Name)
+	o := newOpID("unmount", r.Name, r.ID)
+	err := d.run(o, nil, func() error {
+		return d.release(o, r.Name, r.ID)
+	}, nil)
+
+	return errResponse(err)
+}
+
+// release forgets about a container with mount ID id using a volume,
+// and unmounts the volume if it's not used by other containers
+func (d *ploopDriver) release(o *op, name, id string) error {
+	if !d.delConsumer(name, id) {
+		o.log.Debugf("Volume is still used by other containers")
+		return nil
+	}
+	if err := d.unmount(o, name); err != nil {
+		return err
+	}
+	d.delMount(name)
+
+	return nil
+}
+
+func (d *ploopDriver) unmount(o *op, name string) error {
+	o.log.Debugf("Unmounting volume")
 
-	p, err := ploop.Open(d.dd(r.Name))
+	p, err := ploop.Open(d.dd(name))
 	if err != nil {
-		logrus.Errorf("Can't open ploop: %s", err)
-		return volume.Response{Err: err.Error()}
+		return err
 	}
 	defer p.Close()
 
 	if m, _ := p.IsMounted(); !m {
 		// not mounted, nothing to do
-		return volume.Response{}
+		return nil
 	}
 
-	err = p.Umount()
+	meta, err := d.loadMeta(name)
+	if err != nil {
+		return err
+	}
+	err = d.umountFS(o, p, name, meta)
 	// ignore "is not mounted" error
 	if err != nil && !ploop.IsNotMounted(err) {
-		logrus.Errorf("Can't unmount ploop: %s", err)
-		return volume.Response{Err: err.Error()}
+		return err
 	}
+	os.Remove(d.dirtyMark(name))
 
 	// all went well
-	return volume.Response{}
+	return nil
 }
 
 func (d *ploopDriver) Get(r volume.Request) volume.Response {
-	logrus.Debugf("Called Get(%s)", r.Name)
-
-	exist, err := d.volExist(r.Name)
+	o := newOp("get", r.Name)
+	err := d.run(o, nil, func() error {
+		o.log.Debugf("Called Get")
+		return d.findVol(r.Name)
+	}, nil)
 	if err != nil {
-		return volume.Response{Err: err.Error()}
-	}
-	if !exist {
-		// no such volume
-		return volume.Response{Err: "Can't find volume"}
+		return errResponse(err)
 	}
 
 	// TODO: check if it's mounted
-	return volume.Response{Volume: &volume.Volume{Name: r.Name, Mountpoint: d.mnt(r.Name)}}
+	vol := &volume.Volume{Name: r.Name, Mountpoint: d.mnt(r.Name), Status: d.volStatus(r.Name, true)}
+	return volume.Response{Volume: vol}
 }
 
 func (d *ploopDriver) List(r volume.Request) volume.Response {
-	logrus.Debugf("Called List()")
+	var vols []*volume.Volume
+
+	o := newOp("list", "")
+	err := d.run(o, nil, func() (err error) {
+		o.log.Debugf("Called List")
+		vols, err = d.list()
+		return err
+	}, nil)
+	if err != nil {
+		return errResponse(err)
+	}
+
+	return volume.Response{Volumes: vols}
+}
+
+func (d *ploopDriver) list() ([]*volume.Volume, error) {
 	dir := d.dir("")
 
 	files, err := ioutil.ReadDir(dir)
 	if err != nil {
-		logrus.Errorf("Can't list directory %s: %s", dir, err)
-		return volume.Response{Err: err.Error()}
+		return nil, fmt.Errorf("Can't list directory %s: %s", dir, err)
 	}
 
 	vols := make([]*volume.Volume, 0, len(files))
@@ -332,43 +773,110 @@ func (d *ploopDriver) List(r volume.Request) volume.Response {
 	for _, f := range files {
 		if f.IsDir() {
 			name := f.Name()
-			// Check if DiskDescriptor.xml is there
-			exist, _ := d.volExist(name)
-			if !exist {
+			if !d.isVolume(name) {
 				continue
 			}
 			vol := &volume.Volume{
 				Name:       name,
 				Mountpoint: d.mnt(name),
+				Status:     d.volStatus(name, false),
 			}
 			vols = append(vols, vol)
 		}
 	}
 
-	return volume.Response{Volumes: vols}
+	return vols, nil
 }
 
-func (d *ploopDriver) Path(r volume.Request) volume.Response {
-	logrus.Debugf("Called Path (%s)", r.Name)
-
-	exist, err := d.volExist(r.Name)
+// volStatus returns volume details, as shown by docker volume inspect.
+// It only reads DiskDescriptor.xml (and, if detailed is set, delta
+// headers and BATs), so the image is not locked.
+func (d *ploopDriver) volStatus(name string, detailed bool) map[string]interface{} {
+	if reason := d.brokenReason(name); reason != "" {
+		return map[string]interface{}{statusBroken: reason}
+	}
+	desc, err := diskdescriptor.Read(d.dd(name))
 	if err != nil {
-		return volume.Response{Err: err.Error()}
+		return nil
+	}
+
+	status := map[string]interface{}{
+		"Size":      units.BytesSize(float64(desc.Size)),
+		"BlockSize": units.BytesSize(float64(desc.BlockSize)),
+		"Deltas":    len(desc.Chain()),
+		"Snapshots": len(desc.Snapshots) - 1,
+		"Format":    string(desc.Top().Mode),
+	}
+	if detailed {
+		if m, err := d.loadMeta(name); err == nil && m.KeyID != "" {
+			status["EncryptionKeyID"] = m.KeyID
+		}
+		if usage, err := d.deltasUsage(desc); err != nil {
+			logrus.Warnf("Can't inspect volume %s deltas: %s", name, err)
+		} else {
+			status["Usage"] = usage
+		}
 	}
 
-	if !exist {
-		return volume.Response{Err: "Can't find volume"}
+	return status
+}
+
+func (d *ploopDriver) Path(r volume.Request) volume.Response {
+	o := newOp("path", r.Name)
+	err := d.run(o, nil, func() error {
+		o.log.Debugf("Called Path")
+		return d.findVol(r.Name)
+	}, nil)
+	if err != nil {
+		return errResponse(err)
 	}
 
 	// TODO: check if mounted?
 	return volume.Response{Mountpoint: d.mnt(r.Name)}
 }
+
 func (d *ploopDriver) Capabilities(r volume.Request) volume.Response {
 	return volume.Response{
 		Capabilities: volume.Capability{
 			Scope: d.opts.scope}}
 }
 
+// errResponse returns a response with an error set from err, if any
+func errResponse(err error) volume.Response {
+	if err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+
+	return volume.Response{}
+}
+
+// checkVolName checks if a name can be used for a volume, i.e. as
+// a single path element
+func checkVolName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return fmt.Errorf("Invalid volume name %q", name)
+	}
+
+	return nil
+}
+
+// Returns an error if a given volume does not exist
+func (d *ploopDriver) findVol(name string) error {
+	if err := checkVolName(name); err != nil {
+		return err
+	}
+	exist, err := d.volExist(name)
+	if err != nil {
+		return err
+	}
+	if !exist && !d.isVolume(name) {
+		// no such volume
+		return fmt.Errorf("Can't find volume")
+	}
+
+	return nil
+}
+
 // Check if a given volume exist
 func (d *ploopDriver) volExist(name string) (bool, error) {
 	dd := d.dd(name)
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFindVol(t *testing.T) {
+	home, err := ioutil.TempDir("", "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	d := &ploopDriver{home: home}
+	for _, name := range []string{"vol", ".hidden"} {
+		if err := os.MkdirAll(d.dir(name), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(d.dd(name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{name: "vol", ok: true},
+		{name: ".hidden", ok: true},
+		{name: "nonexistent"},
+		{name: ""},
+		{name: "."},
+		{name: ".."},
+		// a volume, if not for the path
+		{name: "../img/vol"},
+		{name: "vol/"},
+		{name: "/vol"},
+	}
+
+	for _, tc := range tests {
+		if err := d.findVol(tc.name); (err == nil) != tc.ok {
+			t.Errorf("%q: error %v, expected ok %v", tc.name, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-units"
+)
+
+/* Secure erase of removed volumes.
+ *
+ * Instead of just unlinking image files, their allocated data
+ * are either overwritten with zeroes, or discarded (punched out,
+ * which is passed down to the device by filesystems supporting it).
+ * On Virtuozzo storage, discarded chunks are not wiped on chunk
+ * servers, so data are always overwritten there.
+ *
+ * As it takes a while, a volume directory is moved away to
+ * <home>/erase, so the volume is gone for Docker right away, and is
+ * erased in the background. Erase of a directory left there (e.g.
+ * if the plugin was stopped) is resumed on the next start.
+ */
+
+// Secure delete modes
+const (
+	eraseOff       = "off"
+	eraseOverwrite = "overwrite"
+	eraseDiscard   = "discard"
+)
+
+// File in a directory being erased, keeping the erase mode
+const eraseModeFile = ".erase-mode"
+
+// Format of a time suffix of directories being erased
+const eraseTimeFormat = "20060102-150405"
+
+// Size of a chunk to overwrite at once
+const eraseChunk = 1 << 20
+
+// lseek(2) and fallocate(2) flags, not defined by package syscall
+const (
+	seekData        = 3
+	seekHole        = 4
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+)
+
+// checkEraseMode checks if a secure delete mode is valid
+func checkEraseMode(mode string) error {
+	switch mode {
+	case eraseOff, eraseOverwrite, eraseDiscard:
+		return nil
+	}
+
+	return fmt.Errorf("Can't parse secure-delete %s (use off, overwrite or discard)", mode)
+}
+
+// eraseMode returns the secure delete mode of a volume
+func (d *ploopDriver) eraseMode(name string) string {
+	m, err := d.loadMeta(name)
+	if err != nil || m.SecureDelete == "" {
+		return d.opts.secureDelete
+	}
+
+	return m.SecureDelete
+}
+
+// moveToErase moves a volume directory out of the way, to be erased
+func (d *ploopDriver) moveToErase(name, mode string) (string, error) {
+	if err := ioutil.WriteFile(path.Join(d.dir(name), eraseModeFile), []byte(mode), 0600); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(d.erasing(""), 0700); err != nil {
+		return "", err
+	}
+	dst := d.erasing(fmt.Sprintf("%s-%s", name, time.Now().Format(eraseTimeFormat)))
+	if err := os.Rename(d.dir(name), dst); err != nil {
+		return "", err
+	}
+
+	return dst, nil
+}
+
+// startErase starts erasing a directory in the background
+func (d *ploopDriver) startErase(dir string) {
+	// strip the time suffix to get the volume name
+	name := path.Base(dir)
+	if len(name) > len(eraseTimeFormat) {
+		name = name[:len(name)-len(eraseTimeFormat)-1]
+	}
+	mode := eraseOverwrite
+	if b, err := ioutil.ReadFile(path.Join(dir, eraseModeFile)); err == nil {
+		mode = strings.TrimSpace(string(b))
+	}
+	if mode == eraseDiscard && isOnVstorage(dir) {
+		mode = eraseOverwrite
+	}
+
+	o := newOp("erase", name)
+	opts := map[string]string{"mode": mode}
+	// No volume lock here, as the name can be reused right away
+	if err := d.admit(o); err != nil {
+		o.finish(opts, err)
+		return
+	}
+	go func() {
+		defer d.running.Done()
+		err := d.erase(o, dir, mode)
+		o.finish(opts, err)
+	}()
+}
+
+// eraseResume erases whatever was left to be erased by the
+// previous plugin instance
+func (d *ploopDriver) eraseResume() {
+	dirs, err := filepath.Glob(d.erasing("*"))
+	if err != nil {
+		logrus.Errorf("Can't find directories to erase: %s", err)
+		return
+	}
+	for _, dir := range dirs {
+		logrus.Infof("Resuming erase of %s", dir)
+		d.startErase(dir)
+	}
+}
+
+// erase securely erases all files in a directory, then removes it
+func (d *ploopDriver) erase(o *op, dir, mode string) error {
+	defer d.heavyOp(o)()
+
+	var files []string
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			files = append(files, p)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	total := filesUsage(files)
+	var done int64
+	stop := make(chan struct{})
+	go func() {
+		t := time.NewTicker(compactProgress)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				o.setProgress("%s of %s erased",
+					units.BytesSize(float64(atomic.LoadInt64(&done))),
+					units.BytesSize(float64(total)))
+			}
+		}
+	}()
+	defer close(stop)
+
+	o.log.Infof("Erasing %s (%s, %s)", dir, mode, units.BytesSize(float64(total)))
+	for _, f := range files {
+		if err := d.eraseFile(f, mode, &done); err != nil {
+			return fmt.Errorf("Can't erase %s: %s", f, err)
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	o.log.Infof("Erased %s", units.BytesSize(float64(atomic.LoadInt64(&done))))
+
+	return nil
+}
+
+// eraseFile overwrites or discards data of a file, skipping holes.
+// The number of bytes erased is added to done.
+func (d *ploopDriver) eraseFile(file, mode string, done *int64) error {
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	zeroes := make([]byte, eraseChunk)
+
+	for off := int64(0); off < size; {
+		if d.isStopping() {
+			return fmt.Errorf("Interrupted, to be resumed on restart")
+		}
+		// Find the next data region, or assume it's all data
+		// if the filesystem can't tell
+		start, err := f.Seek(off, seekData)
+		if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ENXIO {
+			// no more data
+			break
+		}
+		if err != nil {
+			start = off
+		}
+		end, err := f.Seek(start, seekHole)
+		if err != nil || end > size {
+			end = size
+		}
+
+		if mode == eraseDiscard {
+			err = syscall.Fallocate(int(f.Fd()), fallocPunchHole|fallocKeepSize, start, end-start)
+			if err == nil {
+				atomic.AddInt64(done, end-start)
+				off = end
+				continue
+			}
+			if err != syscall.EOPNOTSUPP {
+				return err
+			}
+			// can't discard, overwrite the rest
+			mode = eraseOverwrite
+		}
+
+		for pos := start; pos < end; {
+			n := end - pos
+			if n > eraseChunk {
+				n = eraseChunk
+			}
+			if _, err := f.WriteAt(zeroes[:n], pos); err != nil {
+				return err
+			}
+			pos += n
+			atomic.AddInt64(done, n)
+		}
+		off = end
+	}
+
+	return f.Sync()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestEraseFile(t *testing.T) {
+	const size = 16 << 20
+	// data extents, at the start, in the middle (unaligned),
+	// and at the end of a sparse file
+	extents := []struct{ off, len int64 }{
+		{0, 64 << 10},
+		{8<<20 + 100, 3 * eraseChunk / 2},
+		{size - 64<<10, 64 << 10},
+	}
+
+	for _, mode := range []string{eraseOverwrite, eraseDiscard} {
+		f, err := ioutil.TempFile("", "erase")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		if err := f.Truncate(size); err != nil {
+			t.Fatal(err)
+		}
+		var total int64
+		for _, e := range extents {
+			if _, err := f.WriteAt(bytes.Repeat([]byte{0xa5}, int(e.len)), e.off); err != nil {
+				t.Fatal(err)
+			}
+			total += e.len
+		}
+		f.Close()
+
+		d := &ploopDriver{}
+		var done int64
+		if err := d.eraseFile(f.Name(), mode, &done); err != nil {
+			t.Errorf("%s: unexpected error: %s", mode, err)
+			continue
+		}
+		if done < total || done > size {
+			t.Errorf("%s: %d bytes erased, expected %d to %d", mode, done, total, size)
+		}
+
+		b, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) != size {
+			t.Errorf("%s: file size changed to %d", mode, len(b))
+		}
+		for _, e := range extents {
+			if !bytes.Equal(b[e.off:e.off+e.len], make([]byte, e.len)) {
+				t.Errorf("%s: extent at %d is not erased", mode, e.off)
+			}
+		}
+	}
+}
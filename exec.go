@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Err is a structure used to return errors from external commands
+type Err struct {
+	cmd string
+	c   int
+	s   string
+}
+
+// Error returns a string representation of a command error
+func (e *Err) Error() string {
+	return fmt.Sprintf("%s error %d: %s", e.cmd, e.c, e.s)
+}
+
+// runCmd runs an external command, writing its stdout to stdout
+// (if not nil). In case of error, the first line of its stderr
+// is returned as a part of Err.
+func runCmd(stdout io.Writer, name string, args ...string) error {
+	return runCmdFiles(stdout, nil, name, args...)
+}
+
+// runCmdTimeout is like runCmd, but kills the command if it is
+// not finished in a given time
+func runCmdTimeout(timeout time.Duration, stdout io.Writer, name string, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return runCmdContext(ctx, stdout, nil, name, args...)
+}
+
+// runCmdFiles is like runCmd, but also passes extra open files
+// to the command, as file descriptors 3, 4 and so on
+func runCmdFiles(stdout io.Writer, files []*os.File, name string, args ...string) error {
+	return runCmdContext(context.Background(), stdout, files, name, args...)
+}
+
+// runCmdContext is a common implementation of the above, killing
+// the command once ctx is done
+func runCmdContext(ctx context.Context, stdout io.Writer, files []*os.File, name string, args ...string) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	cmd.ExtraFiles = files
+
+	logrus.Debugf("Run: %s\n", strings.Join([]string{cmd.Path, strings.Join(cmd.Args[1:], " ")}, " "))
+
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return &Err{cmd: name, c: -1, s: "timed out"}
+	}
+
+	// Command returned an error, get the first line of stderr
+	errStr, _ := stderr.ReadString('\n')
+	errStr = strings.TrimSpace(errStr)
+
+	// Get the exit code (Unix-specific)
+	if exiterr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
+			errCode := status.ExitStatus()
+			return &Err{cmd: name, c: errCode, s: errStr}
+		}
+	}
+	if errStr == "" {
+		// command was not run at all
+		errStr = err.Error()
+	}
+	// unknown exit code
+	return &Err{cmd: name, c: -1, s: errStr}
+}
+
+// ploopCmd runs ploop command line tool, for the functionality
+// not available from goploop
+func ploopCmd(args ...string) error {
+	return runCmd(nil, "ploop", args...)
+}
+
+func ploopCmdOut(args ...string) (string, error) {
+	var stdout bytes.Buffer
+
+	err := runCmd(&stdout, "ploop", args...)
+	return stdout.String(), err
+}
+
+// I/O priorities of background operations
+const (
+	ioniceIdle       = "idle"        // only use disk when no one else does
+	ioniceBestEffort = "best-effort" // lowest best-effort priority
+	ioniceNone       = "none"        // don't change
+)
+
+// ploopCmdNice is like ploopCmd, but runs ploop with a lowered
+// I/O priority, so background operations don't slow down containers
+func ploopCmdNice(class string, args ...string) error {
+	switch class {
+	case ioniceIdle:
+		return runCmd(nil, "ionice", append([]string{"-c", "3", "ploop"}, args...)...)
+	case ioniceBestEffort:
+		return runCmd(nil, "ionice", append([]string{"-c", "2", "-n", "7", "ploop"}, args...)...)
+	}
+
+	return ploopCmd(args...)
+}
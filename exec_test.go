@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunCmdTimeout(t *testing.T) {
+	var out bytes.Buffer
+	if err := runCmdTimeout(time.Second, &out, "echo", "key"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if out.String() != "key\n" {
+		t.Errorf("output %q", out.String())
+	}
+
+	start := time.Now()
+	err := runCmdTimeout(100*time.Millisecond, nil, "sleep", "10")
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("error %v, expected a timeout", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("command was not killed in %s", d)
+	}
+
+	if err := runCmdTimeout(time.Second, nil, "false"); err == nil {
+		t.Error("no error")
+	} else if e, ok := err.(*Err); !ok || e.c != 1 {
+		t.Errorf("error %v, expected exit code 1", err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"path"
 	"strings"
 	"syscall"
 )
@@ -37,28 +38,106 @@ func parseDev(s string) uint64 {
 }
 
 func getFSTypeByDev(dev uint64) (string, error) {
-	mi, err := os.Open("/proc/self/mountinfo")
+	fs, _, err := getMountByDev(dev)
+	return fs, err
+}
+
+// GetFilesystemSource is like GetFilesystemType, but returns
+// the filesystem source (such as a device) rather than its type
+func GetFilesystemSource(path string) (string, error) {
+	var st syscall.Stat_t
+
+	err := syscall.Stat(path, &st)
 	if err != nil {
 		return "", err
 	}
+
+	_, src, err := getMountByDev(st.Dev)
+	return src, err
+}
+
+// getMountByDev finds a filesystem by its dev_t, and returns
+// its type and source
+func getMountByDev(dev uint64) (string, string, error) {
+	mi, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", "", err
+	}
 	defer mi.Close()
 
 	sc := bufio.NewScanner(mi)
 	for sc.Scan() {
 		line := strings.Split(sc.Text(), " ")
 		if len(line) < 10 {
-			return "", fmt.Errorf("Short line in /proc/self/mountinfo: %v\n", line)
+			return "", "", fmt.Errorf("Short line in /proc/self/mountinfo: %v\n", line)
 		}
 		dstr := line[2] // major:minor: value of st_dev for files on filesystem
-		fs := line[8]   // filesystem type:  name of filesystem of the form "type[.subtype]"
 		d := parseDev(dstr)
 		if d == 0 {
-			return "", fmt.Errorf("Can't parse device %s", dstr)
+			return "", "", fmt.Errorf("Can't parse device %s", dstr)
+		}
+		if d != dev {
+			continue
+		}
+		// There might be a few optional fields, terminated by "-"
+		for i := 6; i < len(line)-2; i++ {
+			if line[i] == "-" {
+				fs := line[i+1]  // filesystem type:  name of filesystem of the form "type[.subtype]"
+				src := line[i+2] // mount source: filesystem specific information or "none"
+				return fs, src, nil
+			}
 		}
-		if d == dev {
-			return fs, nil
+		return "", "", fmt.Errorf("Can't parse line in /proc/self/mountinfo: %v\n", line)
+	}
+
+	return "", "", nil
+}
+
+// getMountPoints returns the list of mount points under a given directory
+func getMountPoints(dir string) ([]string, error) {
+	mi, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer mi.Close()
+
+	var mnts []string
+	prefix := path.Clean(dir) + "/"
+	sc := bufio.NewScanner(mi)
+	for sc.Scan() {
+		line := strings.Split(sc.Text(), " ")
+		if len(line) < 10 {
+			return nil, fmt.Errorf("Short line in /proc/self/mountinfo: %v\n", line)
+		}
+		mp := line[4] // mount point relative to the process's root
+		if strings.HasPrefix(mp, prefix) {
+			mnts = append(mnts, mp)
+		}
+	}
+
+	return mnts, sc.Err()
+}
+
+// getMountSources returns the set of sources (such as devices)
+// of all mounted filesystems
+func getMountSources() (map[string]bool, error) {
+	mi, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer mi.Close()
+
+	srcs := make(map[string]bool)
+	sc := bufio.NewScanner(mi)
+	for sc.Scan() {
+		line := strings.Split(sc.Text(), " ")
+		for i := 6; i < len(line)-2; i++ {
+			if line[i] == "-" {
+				srcs[line[i+2]] = true
+				break
+			}
 		}
 	}
 
-	return "", nil
+	return srcs, sc.Err()
 }
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/kolyshkin/docker-volume-ploop/diskdescriptor"
+)
+
+/* Garbage collection.
+ *
+ * Failed or interrupted operations, as well as removed volumes,
+ * might leave some stuff behind: empty mount points, empty volume
+ * directories, delta files not referenced by DiskDescriptor.xml,
+ * temporary files and directories, and ploop devices with no
+ * filesystem mounted.
+ * gc finds (and, unless it's a dry run, removes) such artifacts.
+ */
+
+// Files younger than that are not collected, as they might
+// belong to an operation in progress
+const gcMinAge = time.Hour
+
+// Sysfs directory with block devices
+const sysBlock = "/sys/block"
+
+// Kinds of garbage
+const (
+	gcMountPoint = "mount point"
+	gcVolumeDir  = "volume dir"
+	gcDelta      = "delta"
+	gcTempFile   = "temp file"
+	gcTempDir    = "temp dir"
+	gcDevice     = "device"
+)
+
+// gcItem is a single piece of garbage found
+type gcItem struct {
+	Kind   string
+	Path   string
+	Reason string
+	Error  string `json:",omitempty"` // failed to remove
+}
+
+// Temporary directories of volume operations, which are removed when
+// the operation is finished or recovered
+var gcTempDirs = map[string]string{
+	convertDir:  "unfinished conversion",
+	relayoutDir: "unfinished relayout",
+}
+
+// gcResult is an outcome of garbage collection
+type gcResult struct {
+	DryRun bool
+	Items  []gcItem
+}
+
+// add records a piece of garbage, and removes it using fn
+// unless it's a dry run
+func (r *gcResult) add(o *op, kind, file, reason string, fn func() error) {
+	i := gcItem{Kind: kind, Path: file, Reason: reason}
+	if !r.DryRun {
+		if err := fn(); err != nil {
+			i.Error = err.Error()
+			o.log.Warnf("Can't remove %s %s: %s", kind, file, err)
+		} else {
+			o.log.Infof("Removed %s %s (%s)", kind, file, reason)
+		}
+	}
+	r.Items = append(r.Items, i)
+}
+
+// isOld checks if a file is old enough to be collected
+func isOld(fi os.FileInfo) bool {
+	return time.Since(fi.ModTime()) > gcMinAge
+}
+
+// ploopDevices returns ploop devices with images under img directory,
+// mapped by volume name
+func (d *ploopDriver) ploopDevices() (map[string][]string, error) {
+	devs, err := filepath.Glob(path.Join(sysBlock, "ploop*"))
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := d.dir("") + "/"
+	vols := make(map[string][]string)
+	for _, dev := range devs {
+		b, err := ioutil.ReadFile(path.Join(dev, "pdelta", "0", "image"))
+		if err != nil {
+			// device is not used
+			continue
+		}
+		img := strings.TrimSpace(string(b))
+		if !strings.HasPrefix(img, prefix) {
+			continue
+		}
+		name := strings.SplitN(strings.TrimPrefix(img, prefix), "/", 2)[0]
+		vols[name] = append(vols[name], path.Base(dev))
+	}
+
+	return vols, nil
+}
+
+// gc finds garbage and, unless dryRun is set, removes it
+func (d *ploopDriver) gc(o *op, dryRun bool) (*gcResult, error) {
+	r := gcResult{DryRun: dryRun, Items: []gcItem{}}
+
+	// Find all the names we have something for. Directories being
+	// erased (under <home>/erase) are not looked at, as the erase
+	// runs in background with no volume lock, and removes them.
+	names := make(map[string]bool)
+	for _, dir := range []string{d.dir(""), d.mnt("")} {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if f.IsDir() {
+				names[f.Name()] = true
+			}
+		}
+	}
+	devs, err := d.ploopDevices()
+	if err != nil {
+		return nil, err
+	}
+	for name := range devs {
+		names[name] = true
+	}
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	// Temporary directories of the operations still to be
+	// recovered are left for recovery (or investigation)
+	journaled, err := d.journalVolumes()
+	if err != nil {
+		o.log.Warnf("%s, not collecting temporary directories", err)
+	}
+
+	for _, name := range sorted {
+		if err := d.gcVolume(o, &r, name, devs[name], journaled); err != nil {
+			return nil, err
+		}
+	}
+
+	// Leftovers from interrupted journal writes
+	files, err := ioutil.ReadDir(d.journal(""))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".tmp") && isOld(f) {
+			file := d.journal(f.Name())
+			r.add(o, gcTempFile, file, "unfinished journal write", func() error {
+				return os.Remove(file)
+			})
+		}
+	}
+
+	return &r, nil
+}
+
+// gcVolume collects garbage related to a single volume name.
+// Temporary directories are only collected if journaled is not nil,
+// and has no unfinished operations of the volume.
+func (d *ploopDriver) gcVolume(o *op, r *gcResult, name string, devs []string, journaled map[string]bool) error {
+	d.locks.lock(name)
+	defer d.locks.unlock(name)
+
+	mnts, err := d.mountedVolumes()
+	if err != nil {
+		return err
+	}
+	mounted := false
+	for _, m := range mnts {
+		if m == name {
+			mounted = true
+			break
+		}
+	}
+	isVol := d.isVolume(name)
+
+	// Devices not backing any mounted filesystem
+	if len(devs) > 0 && !mounted {
+		srcs, err := getMountSources()
+		if err != nil {
+			return err
+		}
+		for _, dev := range devs {
+			dev = "/dev/" + dev
+			if srcs[dev] || srcs[dev+"p1"] {
+				continue
+			}
+			r.add(o, gcDevice, dev, fmt.Sprintf("volume %s is not mounted", name), func() error {
+				return ploopCmd("umount", "-d", dev)
+			})
+		}
+	}
+
+	// Mount point of a volume which does not exist
+	mnt := d.mnt(name)
+	if fi, err := os.Stat(mnt); err == nil && fi.IsDir() && !mounted && !isVol {
+		r.add(o, gcMountPoint, mnt, "no such volume", func() error {
+			return os.Remove(mnt)
+		})
+	}
+
+	dir := d.dir(name)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	// Empty volume directory left after a failed create
+	if len(files) == 0 {
+		if fi, err := os.Stat(dir); err == nil && isOld(fi) && !isCreating(name) {
+			r.add(o, gcVolumeDir, dir, "empty", func() error {
+				return os.Remove(dir)
+			})
+		}
+		return nil
+	}
+
+	// Unreferenced deltas (unless we don't know what's referenced)
+	var deltas map[string]bool
+	if d.brokenReason(name) == "" {
+		desc, err := diskdescriptor.Read(d.dd(name))
+		if err != nil {
+			return err
+		}
+		deltas = make(map[string]bool)
+		for _, f := range desc.Files() {
+			deltas[path.Clean(f)] = true
+		}
+	}
+
+	for _, f := range files {
+		file := path.Join(dir, f.Name())
+		switch {
+		case !isOld(f):
+			continue
+		case f.IsDir():
+			if reason, ok := gcTempDirs[f.Name()]; ok && journaled != nil && !journaled[name] {
+				r.add(o, gcTempDir, file, reason, func() error {
+					return os.RemoveAll(file)
+				})
+			}
+		case strings.HasSuffix(f.Name(), ".tmp"):
+			r.add(o, gcTempFile, file, "unfinished write", func() error {
+				return os.Remove(file)
+			})
+		case deltas != nil && strings.HasPrefix(f.Name(), imagePrefix) && !deltas[file]:
+			r.add(o, gcDelta, file, fmt.Sprintf("not referenced by %s", ddxml), func() error {
+				return os.Remove(file)
+			})
+		}
+	}
+
+	return nil
+}
+
+// gcLoop runs garbage collection periodically
+func (d *ploopDriver) gcLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if d.isStopping() {
+			return
+		}
+
+		var r *gcResult
+		o := newOp("gc", "")
+		err := d.runAdmin(o, func() (err error) {
+			r, err = d.gc(o, false)
+			return err
+		})
+		if err == nil && len(r.Items) > 0 {
+			logrus.Infof("Garbage collection: %d item(s) found", len(r.Items))
+		}
+	}
+}
+
+// adminGC runs garbage collection
+func (d *ploopDriver) adminGC(r *http.Request) (interface{}, error) {
+	var res *gcResult
+
+	dryRun := r.FormValue("dry-run") != ""
+	opName := "gc"
+	if dryRun {
+		opName = "gc-dry-run"
+	}
+	o := newOp(opName, "")
+	err := d.runAdmin(o, func() (err error) {
+		res, err = d.gc(o, dryRun)
+		return err
+	})
+
+	return res, err
+}
+
+func cmdGC(args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Only report what would be removed")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return fmt.Errorf("Usage: gc [-dry-run]")
+	}
+
+	q := "/gc"
+	if *dryRun {
+		q += "?dry-run=1"
+	}
+	var r gcResult
+	if err := adminCall("POST", q, nil, &r); err != nil {
+		return err
+	}
+
+	return printJSON(r)
+}
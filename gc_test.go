@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGCSkipsErase(t *testing.T) {
+	home, err := ioutil.TempDir("", "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	d := newPloopDriver(home, &volumeOptions{scope: "local"}, &driverOptions{maxHeavy: 1})
+
+	// a directory being erased, looking like garbage otherwise
+	dir := d.erasing("vol-" + time.Now().Format(eraseTimeFormat))
+	if err := os.MkdirAll(path.Join(dir, convertDir), 0700); err != nil {
+		t.Fatal(err)
+	}
+	files := []string{path.Join(dir, imagePrefix+".1"), path.Join(dir, metaFile+".tmp")}
+	for _, f := range files {
+		if err := ioutil.WriteFile(f, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * gcMinAge)
+	for _, f := range append(files, path.Join(dir, convertDir), dir) {
+		if err := os.Chtimes(f, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := d.gc(newOp("gc", ""), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range r.Items {
+		if strings.HasPrefix(i.Path, d.erasing("")) {
+			t.Errorf("%s %s is collected", i.Kind, i.Path)
+		}
+	}
+	for _, f := range files {
+		if _, err := os.Stat(f); err != nil {
+			t.Errorf("%s is removed", f)
+		}
+	}
+}
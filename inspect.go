@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/kolyshkin/docker-volume-ploop/delta"
+	"github.com/kolyshkin/docker-volume-ploop/diskdescriptor"
+)
+
+// deltaUsage is a delta space consumption, as shown in volume status
+type deltaUsage struct {
+	File      string
+	Allocated string // by clusters allocated
+	DiskUsage string // by the underlying filesystem
+	InUse     bool   `json:",omitempty"`
+	Errors    int    `json:",omitempty"` // BAT problems found
+}
+
+// Max number of deltas to keep inspection results of
+const deltaCacheSize = 1024
+
+// deltaCache keeps delta inspection results, so BATs of deltas which
+// have not changed since (like those of snapshots) are not read again
+// on every Get
+type deltaCache struct {
+	sync.Mutex
+	m map[string]cachedDelta
+}
+
+// cachedDelta is a delta inspection result, which is valid as long
+// as the delta file size and modification time are the same
+type cachedDelta struct {
+	size  int64
+	mtime time.Time
+	info  *delta.Info
+}
+
+// inspect inspects a delta, or returns a cached result
+func (c *deltaCache) inspect(img diskdescriptor.Image) (*delta.Info, error) {
+	fi, err := os.Stat(img.File)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	e, ok := c.m[img.File]
+	c.Unlock()
+	if ok && e.size == fi.Size() && e.mtime.Equal(fi.ModTime()) {
+		return e.info, nil
+	}
+
+	i, err := inspectDelta(img)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	if c.m == nil || len(c.m) >= deltaCacheSize {
+		// start over, rather than track which ones are stale
+		c.m = make(map[string]cachedDelta)
+	}
+	c.m[img.File] = cachedDelta{size: fi.Size(), mtime: fi.ModTime(), info: i}
+	c.Unlock()
+
+	return i, nil
+}
+
+// inspectDelta inspects a delta of an image
+func inspectDelta(img diskdescriptor.Image) (*delta.Info, error) {
+	if img.Mode == diskdescriptor.Plain {
+		return delta.InspectRaw(img.File)
+	}
+
+	return delta.Inspect(img.File)
+}
+
+// inspectDeltas inspects all the deltas of an image, from the base
+// one up to the top, using cache c, unless it's nil
+func inspectDeltas(desc *diskdescriptor.Descriptor, c *deltaCache) ([]*delta.Info, error) {
+	inspect := inspectDelta
+	if c != nil {
+		inspect = c.inspect
+	}
+
+	var list []*delta.Info
+	for _, img := range desc.Chain() {
+		i, err := inspect(img)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", img.File, err)
+		}
+		list = append(list, i)
+	}
+
+	return list, nil
+}
+
+// deltasUsage returns per-delta space consumption of a volume
+func (d *ploopDriver) deltasUsage(desc *diskdescriptor.Descriptor) ([]deltaUsage, error) {
+	list, err := inspectDeltas(desc, &d.deltas)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := make([]deltaUsage, len(list))
+	for n, i := range list {
+		u := deltaUsage{
+			File:      path.Base(i.File),
+			DiskUsage: units.BytesSize(float64(i.DiskUsage)),
+			Errors:    len(i.Errors),
+		}
+		if i.Raw {
+			u.Allocated = units.BytesSize(float64(i.FileSize))
+		} else {
+			u.Allocated = units.BytesSize(float64(i.Allocated * i.ClusterSize))
+			u.InUse = i.InUse
+		}
+		usage[n] = u
+	}
+
+	return usage, nil
+}
+
+func cmdInspectImage(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: inspect-image VOLUME|DD|DELTA")
+	}
+	arg := args[0]
+
+	// Figure out what we are given
+	dd := ""
+	fi, err := os.Stat(arg)
+	switch {
+	case err != nil:
+		// not a file, so a volume name
+		d := ploopDriver{home: *home}
+		dd = d.dd(arg)
+	case fi.IsDir():
+		dd = path.Join(arg, ddxml)
+	case path.Base(arg) == ddxml:
+		dd = arg
+	default:
+		i, err := delta.Inspect(arg)
+		if err != nil {
+			return err
+		}
+		return printJSON(i)
+	}
+
+	desc, err := diskdescriptor.Read(dd)
+	if err != nil {
+		return err
+	}
+	list, err := inspectDeltas(desc, nil)
+	if err != nil {
+		return err
+	}
+	if err := printJSON(list); err != nil {
+		return err
+	}
+	for _, i := range list {
+		if len(i.Errors) > 0 {
+			return fmt.Errorf("Problems found")
+		}
+	}
+
+	return nil
+}
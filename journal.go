@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+/* Intent journal.
+ *
+ * Before a multi-step operation (like create or remove) changes
+ * anything, an intent record is written to <home>/journal. It is
+ * updated as the operation makes progress, and removed once the
+ * operation is finished, successfully or not.
+ *
+ * If the plugin dies in the middle of such an operation, the record
+ * is left behind, and on the next start the operation is either
+ * completed or rolled back, depending on its type and progress.
+ */
+
+// intent is a journal record of an operation in progress
+type intent struct {
+	ID     string
+	Op     string
+	Volume string
+	Time   time.Time
+	Step   string            `json:",omitempty"` // last completed step
+	Args   map[string]string `json:",omitempty"` // operation arguments
+}
+
+// recoverFunc completes or rolls back an unfinished operation
+type recoverFunc func(d *ploopDriver, i *intent) error
+
+// Recovery functions for operation types
+var recoverers = map[string]recoverFunc{
+	"create":   recoverCreate,
+	"remove":   recoverRemove,
+	"convert":  recoverConvert,
+	"relayout": recoverRelayout,
+	"rename":   recoverRename,
+}
+
+// journalBegin records an intent to perform operation o
+func (d *ploopDriver) journalBegin(o *op, args map[string]string) (*intent, error) {
+	i := intent{
+		ID:     fmt.Sprintf("%s-%s-%d", o.name, o.vol, time.Now().UnixNano()),
+		Op:     o.name,
+		Volume: o.vol,
+		Time:   time.Now(),
+		Args:   args,
+	}
+	if err := d.journalWrite(&i); err != nil {
+		return nil, fmt.Errorf("Can't write journal: %s", err)
+	}
+
+	return &i, nil
+}
+
+// journalStep records that the operation has completed step
+func (d *ploopDriver) journalStep(i *intent, step string) error {
+	i.Step = step
+	if err := d.journalWrite(i); err != nil {
+		return fmt.Errorf("Can't write journal: %s", err)
+	}
+
+	return nil
+}
+
+// journalEnd removes the intent record once the operation is finished
+func (d *ploopDriver) journalEnd(i *intent) error {
+	if err := os.Remove(d.journal(i.ID)); err != nil {
+		return fmt.Errorf("Can't remove journal record: %s", err)
+	}
+
+	return syncDir(d.journal(""))
+}
+
+// journalDone is journalEnd to be deferred, which sets *err
+// (unless the operation has failed already) if it fails
+func (d *ploopDriver) journalDone(i *intent, err *error) {
+	if e := d.journalEnd(i); e != nil && *err == nil {
+		*err = e
+	}
+}
+
+// journalWrite writes the intent record safely, so that it's either
+// the old or the new contents in it after a crash
+func (d *ploopDriver) journalWrite(i *intent) error {
+	b, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+
+	file := d.journal(i.ID)
+	tmp := file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return syncDir(d.journal(""))
+}
+
+// syncDir makes sure directory entries changes are on disk
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
+
+// journalRecover goes through the records of the operations
+// which were not finished, completing or rolling them back
+func (d *ploopDriver) journalRecover() {
+	dir := d.journal("")
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		logrus.Errorf("Can't read journal directory %s: %s", dir, err)
+		return
+	}
+
+	for _, f := range files {
+		file := path.Join(dir, f.Name())
+		if strings.HasSuffix(f.Name(), ".tmp") {
+			// unfinished write
+			os.Remove(file)
+			continue
+		}
+
+		i, err := readIntent(file)
+		if err != nil {
+			logrus.Error(err)
+			continue
+		}
+
+		l := logrus.WithFields(logrus.Fields{fieldOp: i.Op, fieldVolume: i.Volume})
+		fn, ok := recoverers[i.Op]
+		if !ok {
+			l.Errorf("Don't know how to recover unfinished operation, see %s", file)
+			continue
+		}
+		l.Warnf("Recovering unfinished operation (started %s, step %q)", i.Time, i.Step)
+		if err := fn(d, i); err != nil {
+			l.Errorf("Can't recover unfinished operation, see %s: %s", file, err)
+			continue
+		}
+		if err := d.journalEnd(i); err != nil {
+			l.Error(err)
+		}
+	}
+}
+
+// readIntent reads a journal record
+func readIntent(file string) (*intent, error) {
+	var i intent
+	b, err := ioutil.ReadFile(file)
+	if err == nil {
+		err = json.Unmarshal(b, &i)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Can't read journal record %s: %s", file, err)
+	}
+
+	return &i, nil
+}
+
+// journalVolumes returns names of the volumes having unfinished
+// operations recorded in the journal
+func (d *ploopDriver) journalVolumes() (map[string]bool, error) {
+	files, err := ioutil.ReadDir(d.journal(""))
+	if err != nil {
+		return nil, err
+	}
+
+	vols := make(map[string]bool)
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".tmp") {
+			continue
+		}
+		i, err := readIntent(d.journal(f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		vols[i.Volume] = true
+	}
+
+	return vols, nil
+}
+
+// recoverCreate rolls back an unfinished volume creation
+func recoverCreate(d *ploopDriver, i *intent) error {
+	if i.Step == "" {
+		// nothing was created yet
+		return nil
+	}
+	if i.Step == "done" {
+		// the volume is complete
+		return nil
+	}
+	if _, err := os.Stat(d.meta(i.Volume)); err == nil {
+		// metadata are written last, so it's complete, too
+		return nil
+	}
+
+	// the directory might not be created yet, which is fine
+	return os.RemoveAll(d.dir(i.Volume))
+}
+
+// recoverRemove completes an unfinished volume removal
+func recoverRemove(d *ploopDriver, i *intent) error {
+	if mode := i.Args["erase"]; mode != "" {
+		// to be erased by eraseResume
+		if _, err := os.Stat(d.dir(i.Volume)); os.IsNotExist(err) {
+			return nil
+		}
+		_, err := d.moveToErase(i.Volume, mode)
+		return err
+	}
+
+	return os.RemoveAll(d.dir(i.Volume))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRecoverCreate(t *testing.T) {
+	home, err := ioutil.TempDir("", "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	d := &ploopDriver{home: home}
+
+	tests := []struct {
+		name  string
+		step  string
+		files []string // volume files present before recovery
+		kept  bool     // the volume directory is kept
+	}{
+		{name: "not started", step: ""},
+		{name: "not started, someone else's directory", step: "", files: []string{ddxml}, kept: true},
+		{name: "mkdir, no directory", step: "mkdir"},
+		{name: "mkdir, empty directory", step: "mkdir", files: []string{}},
+		{name: "mkdir, image created", step: "mkdir", files: []string{ddxml, imagePrefix}},
+		{name: "mkdir, metadata written", step: "mkdir", files: []string{ddxml, imagePrefix, metaFile}, kept: true},
+		{name: "done", step: "done", files: []string{ddxml, imagePrefix, metaFile}, kept: true},
+	}
+
+	for _, tc := range tests {
+		dir := d.dir("vol")
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatal(err)
+		}
+		if tc.files != nil {
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range tc.files {
+				if err := ioutil.WriteFile(path.Join(dir, f), nil, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		if err := recoverCreate(d, &intent{Op: "create", Volume: "vol", Step: tc.step}); err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.name, err)
+			continue
+		}
+		_, err := os.Stat(dir)
+		if kept := err == nil; kept != tc.kept {
+			t.Errorf("%s: directory kept %v, expected %v", tc.name, kept, tc.kept)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+/* Encryption key providers.
+ *
+ * Keys are identified by IDs, which are generated by the driver and
+ * kept in volume metadata, while the keys themselves are obtained
+ * from a provider, set by the -key-provider flag:
+ *
+ * - dir:DIR keeps keys in DIR/ID files;
+ *
+ * - command:CMD runs "CMD get ID" to get a key, and "CMD new ID"
+ *   to generate and store a new one, which print the key to stdout;
+ *
+ * - http://URL (or https://URL) does GET URL/ID to get a key, and
+ *   POST URL/ID for a new one, with the key returned as the body;
+ *
+ * - unix:SOCK is the same as http://, but over a unix socket. The
+ *   key-server command serves this from a directory. It has no
+ *   authentication of its own, so it only listens on a socket
+ *   accessible by root.
+ *
+ * Keys are binary, from keyMinSize to keyMaxSize bytes long.
+ */
+
+// Key size, in bytes
+const (
+	keySize    = 64 // for keys generated by us
+	keyMinSize = 16
+	keyMaxSize = 8192
+)
+
+// How long to wait for a key from an external provider
+const keyTimeout = 30 * time.Second
+
+var keyIDRe = regexp.MustCompile(`^[a-zA-Z0-9_{}-][a-zA-Z0-9_.{}-]*$`)
+
+// keyProvider gets and generates encryption keys
+type keyProvider interface {
+	getKey(id string) ([]byte, error)
+	newKey(id string) ([]byte, error)
+}
+
+// newKeyProvider returns a key provider by its spec
+func newKeyProvider(spec string) (keyProvider, error) {
+	switch {
+	case spec == "":
+		return nil, nil
+	case strings.HasPrefix(spec, "dir:"):
+		dir := strings.TrimPrefix(spec, "dir:")
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", dir)
+		}
+		return dirKeys(dir), nil
+	case strings.HasPrefix(spec, "command:"):
+		return cmdKeys(strings.TrimPrefix(spec, "command:")), nil
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return httpKeys{url: strings.TrimSuffix(spec, "/"), c: &http.Client{Timeout: keyTimeout}}, nil
+	case strings.HasPrefix(spec, "unix:"):
+		sock := strings.TrimPrefix(spec, "unix:")
+		c := http.Client{Timeout: keyTimeout, Transport: unixTransport(sock)}
+		return httpKeys{url: "http://keys", c: &c}, nil
+	}
+
+	return nil, fmt.Errorf("Can't parse key provider %s (use dir:DIR, command:CMD, http://URL, or unix:SOCK)", spec)
+}
+
+// checkKey checks if a key is sane
+func checkKey(id string, key []byte) ([]byte, error) {
+	if len(key) < keyMinSize || len(key) > keyMaxSize {
+		return nil, fmt.Errorf("Bad key %s size %d (should be from %d to %d bytes)", id, len(key), keyMinSize, keyMaxSize)
+	}
+
+	return key, nil
+}
+
+// checkKeyID checks if a key ID is safe to use as a file name or in URL
+func checkKeyID(id string) error {
+	if !keyIDRe.MatchString(id) {
+		return fmt.Errorf("Invalid key ID %s", id)
+	}
+
+	return nil
+}
+
+// dirKeys keeps keys as files in a directory
+type dirKeys string
+
+func (k dirKeys) getKey(id string) ([]byte, error) {
+	if err := checkKeyID(id); err != nil {
+		return nil, err
+	}
+	key, err := ioutil.ReadFile(path.Join(string(k), id))
+	if err != nil {
+		return nil, err
+	}
+
+	return checkKey(id, key)
+}
+
+func (k dirKeys) newKey(id string) ([]byte, error) {
+	if err := checkKeyID(id); err != nil {
+		return nil, err
+	}
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	file := path.Join(string(k), id)
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(key)
+	if e := f.Sync(); err == nil {
+		err = e
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(file)
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// cmdKeys gets keys from an external command
+type cmdKeys string
+
+func (k cmdKeys) run(action, id string) ([]byte, error) {
+	if err := checkKeyID(id); err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := runCmdTimeout(keyTimeout, &out, string(k), action, id); err != nil {
+		return nil, err
+	}
+
+	return checkKey(id, out.Bytes())
+}
+
+func (k cmdKeys) getKey(id string) ([]byte, error) {
+	return k.run("get", id)
+}
+
+func (k cmdKeys) newKey(id string) ([]byte, error) {
+	return k.run("new", id)
+}
+
+// httpKeys gets keys from an HTTP server
+type httpKeys struct {
+	url string
+	c   *http.Client
+}
+
+func (k httpKeys) do(method, id string) ([]byte, error) {
+	if err := checkKeyID(id); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, k.url+"/"+id, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := k.c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, keyMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Key server returned %s", resp.Status)
+	}
+
+	return checkKey(id, body)
+}
+
+func (k httpKeys) getKey(id string) ([]byte, error) {
+	return k.do("GET", id)
+}
+
+func (k httpKeys) newKey(id string) ([]byte, error) {
+	return k.do("POST", id)
+}
+
+// keyHandler serves keys from a provider, for use with an http://
+// or unix: key provider
+func keyHandler(keys keyProvider) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var key []byte
+		var err error
+
+		id := strings.TrimPrefix(r.URL.Path, "/")
+		switch r.Method {
+		case "GET":
+			key, err = keys.getKey(id)
+		case "POST":
+			key, err = keys.newKey(id)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			logrus.Warnf("%s %s: %s", r.Method, id, err)
+			code := http.StatusInternalServerError
+			if os.IsNotExist(err) {
+				code = http.StatusNotFound
+			}
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+		logrus.Infof("%s %s: OK", r.Method, id)
+		w.Write(key)
+	})
+}
+
+// cmdKeyServer serves keys from a directory on a unix socket,
+// for use with a unix: key provider
+func cmdKeyServer(args []string) error {
+	fs := flag.NewFlagSet("key-server", flag.ExitOnError)
+	sock := fs.String("socket", "/run/docker-volume-ploop/keys.sock", "Unix socket to listen on")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("Usage: key-server [-socket SOCK] DIR")
+	}
+	keys, err := newKeyProvider("dir:" + fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	l, err := listenUnix(*sock)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Serving keys from %s on %s", fs.Arg(0), *sock)
+
+	return http.Serve(l, keyHandler(keys))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestKeyServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyDir := path.Join(dir, "keys")
+	if err := os.Mkdir(keyDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	server, err := newKeyProvider("dir:" + keyDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sock := path.Join(dir, "run", "keys.sock")
+	l, err := listenUnix(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(l, keyHandler(server))
+
+	if fi, err := os.Stat(sock); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf("socket mode %s, expected 0600", fi.Mode().Perm())
+	}
+
+	keys, err := newKeyProvider("unix:" + sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := keys.newKey("vol1")
+	if err != nil {
+		t.Fatalf("new key: %s", err)
+	}
+	if len(key) != keySize {
+		t.Errorf("key size %d, expected %d", len(key), keySize)
+	}
+	got, err := keys.getKey("vol1")
+	if err != nil {
+		t.Fatalf("get key: %s", err)
+	}
+	if !bytes.Equal(got, key) {
+		t.Error("got a different key")
+	}
+
+	if _, err := keys.getKey("nonexistent"); err == nil {
+		t.Error("no error for a nonexistent key")
+	}
+	if _, err := keys.getKey("../vol1"); err == nil {
+		t.Error("no error for an invalid key ID")
+	}
+}
+
+func TestNewKeyProvider(t *testing.T) {
+	for _, spec := range []string{"http://localhost:8400/", "https://keys", "unix:/run/keys.sock", "command:/bin/true"} {
+		if k, err := newKeyProvider(spec); err != nil || k == nil {
+			t.Errorf("%s: %v, %v", spec, k, err)
+		}
+	}
+	for _, spec := range []string{"tcp://localhost:8400", "/run/keys.sock", "dir:/nonexistent"} {
+		if _, err := newKeyProvider(spec); err == nil {
+			t.Errorf("%s: no error", spec)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/kolyshkin/goploop"
+)
+
+// libploop log levels (the higher, the more verbose)
+const (
+	ploopLogErrors  = -1
+	ploopLogDefault = 0
+	ploopLogDebug   = 4
+)
+
+// Write end of the pipe libploop logs to. It is never closed,
+// since libploop keeps writing to it for the process lifetime.
+var ploopLogPipe *os.File
+
+// Timestamp libploop might prefix its log lines with
+var ploopLogTS = regexp.MustCompile(`^\[?[0-9]{4}-[0-9]{2}-[0-9]{2}[T ][0-9:.+-]+\]?\s*:?\s*`)
+
+// ploopLogLevel maps a logrus log level to a libploop one
+func ploopLogLevel(l logrus.Level) int {
+	switch {
+	case l >= logrus.DebugLevel:
+		return ploopLogDebug
+	case l >= logrus.WarnLevel:
+		return ploopLogDefault
+	}
+
+	return ploopLogErrors
+}
+
+// setupPloopLog makes libploop log to a pipe rather than a console,
+// and starts forwarding whatever comes out of the pipe to our log.
+func setupPloopLog() error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	// libploop wants a file name, so let it reopen our pipe
+	if err := ploop.SetLogFile(fmt.Sprintf("/proc/self/fd/%d", w.Fd())); err != nil {
+		r.Close()
+		w.Close()
+		return err
+	}
+	ploopLogPipe = w
+
+	ploop.SetVerboseLevel(ploop.NoConsole)
+	ploop.SetLogLevel(ploopLogLevel(logrus.GetLevel()))
+
+	go forwardPloopLog(r)
+
+	return nil
+}
+
+// forwardPloopLog reads libploop log lines from r and logs them,
+// attributed to the operation in progress
+func forwardPloopLog(r io.Reader) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(ploopLogTS.ReplaceAllString(sc.Text(), ""))
+		if line == "" {
+			continue
+		}
+
+		l := inFlightLog().WithField(fieldSource, "libploop")
+		lower := strings.ToLower(line)
+		switch {
+		case strings.HasPrefix(lower, "error"):
+			l.Error(line)
+		case strings.HasPrefix(lower, "warning"):
+			l.Warn(line)
+		default:
+			l.Info(line)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		logrus.Errorf("Can't read libploop log: %s", err)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// Metrics exported via the admin API
+var metrics = expvar.NewMap("ploop")
+
+// Metric names
+const (
+	metricLockWaits  = "volume_lock_waits"
+	metricLockWait   = "volume_lock_wait_seconds"
+	metricHeavyWaits = "heavy_op_waits"
+	metricHeavyWait  = "heavy_op_wait_seconds"
+	metricHeavyQueue = "heavy_op_queue"
+	metricHeavyRun   = "heavy_op_running"
+	metricTimeouts   = "op_timeouts"
+)
+
+// volLock is a lock of a single volume
+type volLock struct {
+	sync.Mutex
+	refs int // number of users (holders and waiters)
+}
+
+// volLocks is a set of per-volume locks, used to serialize
+// operations on the same volume
+type volLocks struct {
+	sync.Mutex
+	m map[string]*volLock
+}
+
+func (l *volLocks) lock(name string) {
+	l.Lock()
+	if l.m == nil {
+		l.m = make(map[string]*volLock)
+	}
+	vl, ok := l.m[name]
+	if !ok {
+		vl = &volLock{}
+		l.m[name] = vl
+	}
+	vl.refs++
+	l.Unlock()
+
+	vl.Lock()
+}
+
+func (l *volLocks) unlock(name string) {
+	l.Lock()
+	vl := l.m[name]
+	vl.refs--
+	if vl.refs == 0 {
+		delete(l.m, name)
+	}
+	l.Unlock()
+
+	vl.Unlock()
+}
+
+// lockVol takes a lock of the volume operation o is performed on,
+// and returns a function to release it
+func (d *ploopDriver) lockVol(o *op) func() {
+	start := time.Now()
+	d.locks.lock(o.vol)
+	wait := time.Since(start)
+
+	metrics.Add(metricLockWaits, 1)
+	metrics.AddFloat(metricLockWait, wait.Seconds())
+	o.log.WithField(fieldLockWait, wait.String()).Debugf("Volume locked")
+
+	return func() {
+		d.locks.unlock(o.vol)
+	}
+}
+
+// heavyOp waits until the number of expensive operations
+// (such as creating a preallocated image) running in parallel
+// drops below the limit, and returns a function to be called
+// once the operation is finished
+func (d *ploopDriver) heavyOp(o *op) func() {
+	start := time.Now()
+	metrics.Add(metricHeavyQueue, 1)
+	d.heavy <- struct{}{}
+	metrics.Add(metricHeavyQueue, -1)
+	wait := time.Since(start)
+
+	metrics.Add(metricHeavyRun, 1)
+	metrics.Add(metricHeavyWaits, 1)
+	metrics.AddFloat(metricHeavyWait, wait.Seconds())
+	o.log.WithField(fieldHeavyWait, wait.String()).Debugf("Starting expensive operation")
+
+	return func() {
+		<-d.heavy
+		metrics.Add(metricHeavyRun, -1)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/kolyshkin/goploop"
+)
+
+// Names of the fields used in structured log messages
+const (
+	fieldOp        = "op"
+	fieldVolume    = "volume"
+	fieldMountID   = "mount_id"
+	fieldDuration  = "duration"
+	fieldPloopErr  = "ploop_error"
+	fieldOps       = "ops"
+	fieldSource    = "source"
+	fieldLockWait  = "lock_wait"
+	fieldHeavyWait = "queue_wait"
+)
+
+// setLogFormat sets the log output format (text or json)
+func setLogFormat(format string) error {
+	switch format {
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("Unknown log format %s (use text or json)", format)
+	}
+
+	return nil
+}
+
+// ploopErrCode returns a short name of ploop error code (like E_MOUNT)
+// if err is a ploop error, or an empty string otherwise
+func ploopErrCode(err error) string {
+	for c, s := range ploop.ErrCodes {
+		if ploop.IsError(err, c) {
+			return s
+		}
+	}
+
+	return ""
+}
+
+// op describes a single driver operation in progress.
+// It is used to log and audit the operation in a consistent way.
+type op struct {
+	name  string // operation name (create, mount etc.)
+	vol   string // volume name
+	id    string // mount ID (for mount/unmount)
+	start time.Time
+	log   *logrus.Entry
+
+	ownLock bool // the operation locks the volume by itself, as needed
+
+	timedOut int32        // set (atomically) once the operation has timed out
+	progress atomic.Value // progress of a long operation, as a string
+}
+
+func newOp(name, vol string) *op {
+	return newOpID(name, vol, "")
+}
+
+func newOpID(name, vol, id string) *op {
+	f := logrus.Fields{fieldOp: name}
+	if vol != "" {
+		f[fieldVolume] = vol
+	}
+	if id != "" {
+		f[fieldMountID] = id
+	}
+
+	o := &op{
+		name:  name,
+		vol:   vol,
+		id:    id,
+		start: time.Now(),
+		log:   logrus.WithFields(f),
+	}
+
+	opsM.Lock()
+	ops[o] = struct{}{}
+	opsM.Unlock()
+
+	return o
+}
+
+// String returns a short operation description, like "mount(vol1)"
+func (o *op) String() string {
+	return fmt.Sprintf("%s(%s)", o.name, o.vol)
+}
+
+// setProgress updates the progress of a long operation
+func (o *op) setProgress(format string, args ...interface{}) {
+	o.progress.Store(fmt.Sprintf(format, args...))
+}
+
+// getProgress returns the operation progress, if known
+func (o *op) getProgress() string {
+	s, _ := o.progress.Load().(string)
+	return s
+}
+
+// Operations currently in progress
+var (
+	opsM sync.Mutex
+	ops  = make(map[*op]struct{})
+)
+
+// inFlight returns the operations currently in progress,
+// oldest first
+func inFlight() []*op {
+	opsM.Lock()
+	list := make([]*op, 0, len(ops))
+	for o := range ops {
+		list = append(list, o)
+	}
+	opsM.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].start.Before(list[j].start)
+	})
+
+	return list
+}
+
+// inFlightLog returns a log entry attributed to the operation
+// in progress. If there are many, all of them are listed.
+func inFlightLog() *logrus.Entry {
+	list := inFlight()
+	switch len(list) {
+	case 0:
+		return logrus.NewEntry(logrus.StandardLogger())
+	case 1:
+		return list[0].log
+	}
+
+	s := make([]string, len(list))
+	for i, o := range list {
+		s[i] = o.String()
+	}
+	return logrus.WithField(fieldOps, strings.Join(s, ","))
+}
+
+// finish logs the operation outcome and, for mutating operations,
+// records it into the audit log. Operation options (if any) are
+// passed in opts.
+func (o *op) finish(opts map[string]string, err error) {
+	opsM.Lock()
+	delete(ops, o)
+	opsM.Unlock()
+
+	dur := time.Since(o.start)
+	l := o.log.WithField(fieldDuration, dur.String())
+	if err != nil {
+		if code := ploopErrCode(err); code != "" {
+			l = l.WithField(fieldPloopErr, code)
+		}
+		l.Errorf("Failed: %s", err)
+	} else {
+		l.Debugf("Done")
+	}
+
+	if isMutating(o.name) {
+		audit.record(o, opts, dur, err)
+	}
+}
@@ -5,28 +5,52 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"path/filepath"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/go-plugins-helpers/volume"
-	"github.com/kolyshkin/goploop"
+	"github.com/docker/go-units"
 )
 
 // Options and their default values
 var (
-	home  = flag.String("home", "/pcs", "Base directory where volumes are created")
-	scope = flag.String("scope", "auto", "Volumes scope (local or global)")
-	size  = flag.String("size", "16GB", "Default image size")
-	mode  = flag.String("mode", "expanded", "Default ploop image mode")
-	clog  = flag.String("clog", "0", "Cluster block log size in 512-byte sectors")
-	tier  = flag.String("tier", "-1", "Virtuozzo Storage tier (0 is fastest")
-	help  = flag.Bool("help", false, "Print usage information")
-	debug = flag.Bool("debug", false, "Be verbose")
-	quiet = flag.Bool("quiet", false, "Be quiet (errors only, to stderr)")
+	home    = flag.String("home", "/pcs", "Base directory where volumes are created")
+	scope   = flag.String("scope", "auto", "Volumes scope (local or global)")
+	size    = flag.String("size", "16GB", "Default image size")
+	mode    = flag.String("mode", "expanded", "Default ploop image mode")
+	clog    = flag.String("clog", "0", "Cluster block log size in 512-byte sectors")
+	tier    = flag.String("tier", "-1", "Virtuozzo Storage tier (0 is fastest")
+	fsck    = flag.String("fsck", fsckAuto, "Default fsck policy on mount (always, auto or never)")
+	compact = flag.String("compact", "0", "Default compaction interval (0 to disable)")
+	mntOpts = flag.String("mount-opts", "", "Default mount options, comma-separated")
+	userns  = flag.String("userns-remap", "", "Docker userns-remap user, to shift volume root owner IDs by")
+	selinux = flag.String("selinux", selinuxNone, "Default SELinux labelling of volumes (shared, private or none)")
+	erase   = flag.String("secure-delete", eraseOff, "Default secure delete mode of removed volumes (off, overwrite or discard)")
+	help    = flag.Bool("help", false, "Print usage information")
+	debug   = flag.Bool("debug", false, "Be verbose")
+	quiet   = flag.Bool("quiet", false, "Be quiet (errors only, to stderr)")
+
+	logFormat = flag.String("log-format", "text", "Log format (text or json)")
+	auditFile = flag.String("audit-log", "", "Audit log file (empty to disable)")
+	auditSize = flag.String("audit-log-size", "10MB", "Rotate audit log after this size")
+	auditKeep = flag.Int("audit-log-keep", 5, "Number of rotated audit logs to keep")
+
+	adminSock = flag.String("admin", "/run/docker-volume-ploop/admin.sock", "Admin API socket")
+	maxHeavy  = flag.Int("max-heavy", 2, "Maximum number of expensive operations run in parallel")
+	timeout   = flag.Duration("timeout", 2*time.Minute, "Operation timeout (0 to disable)")
+
+	onShutdown   = flag.String("on-shutdown", onShutdownKeep, "What to do with mounted volumes on shutdown (keep, or unmount the unused ones)")
+	shutdownWait = flag.Duration("shutdown-timeout", time.Minute, "How long to wait for operations in progress on shutdown")
+	gcInterval   = flag.Duration("gc-interval", 0, "How often to collect garbage (0 to disable)")
+	keyProv      = flag.String("key-provider", "", "Encryption key provider (dir:DIR, command:CMD, http://URL, or unix:SOCK)")
+	ionice       = flag.String("ionice", ioniceIdle, "I/O priority of background operations (idle, best-effort or none)")
 )
 
 func usage(ret int) {
-	fmt.Printf("Usage: %s [options]\n", path.Base(os.Args[0]))
+	fmt.Printf("Usage: %s [options] [command [args]]\n", path.Base(os.Args[0]))
 	flag.PrintDefaults()
+	commandsUsage()
 
 	os.Exit(ret)
 }
@@ -38,23 +62,48 @@ func main() {
 		usage(0)
 	}
 
+	if flag.NArg() > 0 {
+		runCommand(flag.Args())
+	}
+
 	// Fill in the default volume options
 	var opts volumeOptions
 
 	if err := opts.setSize(*size); err != nil {
-		logrus.Fatalf(err.Error())
+		logrus.Fatal(err)
 	}
 	if err := opts.setMode(*mode); err != nil {
-		logrus.Fatalf(err.Error())
+		logrus.Fatal(err)
 	}
 	if err := opts.setCLog(*clog); err != nil {
-		logrus.Fatalf(err.Error())
+		logrus.Fatal(err)
 	}
 	if err := opts.setTier(*tier); err != nil {
-		logrus.Fatalf(err.Error())
+		logrus.Fatal(err)
 	}
 	if err := opts.setScope(*scope); err != nil {
-		logrus.Fatalf(err.Error())
+		logrus.Fatal(err)
+	}
+	if err := opts.setFsck(*fsck); err != nil {
+		logrus.Fatal(err)
+	}
+	if err := opts.setCompact(*compact); err != nil {
+		logrus.Fatal(err)
+	}
+	if err := opts.setMountOpts(*mntOpts); err != nil {
+		logrus.Fatal(err)
+	}
+	if err := opts.setUsernsRemap(*userns); err != nil {
+		logrus.Fatal(err)
+	}
+	if err := opts.setSELinux(*selinux); err != nil {
+		logrus.Fatal(err)
+	}
+	if err := opts.setSecureDelete(*erase); err != nil {
+		logrus.Fatal(err)
+	}
+	if opts.selinux != selinuxNone && !selinuxEnabled() {
+		logrus.Warnf("SELinux is not enabled, volumes will not be labelled")
 	}
 
 	// Set log level
@@ -63,20 +112,95 @@ func main() {
 			logrus.Fatalf("Flags 'debug' and 'quiet' are mutually exclusive")
 		}
 		logrus.SetLevel(logrus.DebugLevel)
-		ploop.SetVerboseLevel(ploop.Timestamps)
 		logrus.Debugf("Debug logging enabled")
 	}
 	if *quiet {
 		logrus.SetOutput(os.Stderr)
 		logrus.SetLevel(logrus.ErrorLevel)
-		ploop.SetVerboseLevel(ploop.NoStdout)
+	}
+
+	if err := setLogFormat(*logFormat); err != nil {
+		logrus.Fatal(err)
+	}
+
+	// Forward libploop messages to our log
+	if err := setupPloopLog(); err != nil {
+		logrus.Fatalf("Can't set up libploop logging: %s", err)
+	}
+
+	// Set up audit log
+	if *auditFile != "" {
+		sz, err := units.RAMInBytes(*auditSize)
+		if err != nil {
+			logrus.Fatalf("Can't parse audit log size %s: %s", *auditSize, err)
+		}
+		audit, err = newAuditLog(*auditFile, sz, *auditKeep)
+		if err != nil {
+			logrus.Fatalf("Can't open audit log: %s", err)
+		}
+	}
+
+	// Fill in the driver options
+	dopts := driverOptions{
+		maxHeavy: *maxHeavy,
+		timeout:  *timeout,
+		ionice:   *ionice,
+	}
+	if dopts.maxHeavy < 1 {
+		logrus.Fatalf("Invalid max-heavy value %d", dopts.maxHeavy)
+	}
+	if *onShutdown != onShutdownKeep && *onShutdown != onShutdownUnmount {
+		logrus.Fatalf("Invalid on-shutdown value %s", *onShutdown)
+	}
+	if dopts.timeout < 0 {
+		logrus.Fatalf("Invalid timeout value %s", dopts.timeout)
+	}
+	switch dopts.ionice {
+	case ioniceIdle, ioniceBestEffort, ioniceNone:
+	default:
+		logrus.Fatalf("Invalid ionice value %s", dopts.ionice)
+	}
+	keys, err := newKeyProvider(*keyProv)
+	if err != nil {
+		logrus.Fatalf("Invalid key-provider value: %s", err)
+	}
+	dopts.keys = keys
+	if *gcInterval < 0 {
+		logrus.Fatalf("Invalid gc-interval value %s", *gcInterval)
 	}
 
 	// Let's run!
-	d := newPloopDriver(*home, &opts)
+	d := newPloopDriver(*home, &opts, &dopts)
+	if err := d.serveAdmin(*adminSock); err != nil {
+		logrus.Fatalf("Can't start admin API: %s", err)
+	}
 	h := volume.NewHandler(d)
-	e := h.ServeUnix("root", "ploop")
-	if e != nil {
-		logrus.Fatalf("Failed to initialize: %s", e)
+	l, sock, err := pluginListener(pluginName, "root")
+	if err != nil {
+		logrus.Fatalf("Failed to initialize: %s", err)
+	}
+	if sock != "" {
+		defer os.Remove(sock)
+	}
+	done := d.handleSignals(l, *onShutdown, *shutdownWait)
+
+	// Home is fine, mounts are recovered, we're ready to serve
+	status, err := d.status()
+	if err != nil {
+		logrus.Fatalf("Can't get status: %s", err)
+	}
+	sdNotify("READY=1\nSTATUS=" + status)
+	go d.healthLoop(filepath.Join(pluginSockDir, pluginName+".sock"))
+	if *gcInterval > 0 {
+		go d.gcLoop(*gcInterval)
+	}
+	go d.compactLoop()
+	d.eraseResume()
+
+	err = h.Serve(l)
+	if !d.isStopping() {
+		logrus.Fatalf("Failed to serve: %s", err)
 	}
+	<-done
+	logrus.Infof("Exiting")
 }
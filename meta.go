@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// volumeMeta holds volume settings which are not a part of ploop image
+// itself, but need to be known to the driver. It is stored as JSON
+// next to DiskDescriptor.xml.
+type volumeMeta struct {
+	// image mode, as it can't be told by the image itself
+	ImageMode string `json:",omitempty"`
+	Fsck      string `json:",omitempty"` // fsck policy on mount
+	Compact   string `json:",omitempty"` // compaction interval
+	// inner filesystem type and mkfs options, if given on create
+	FSType string            `json:",omitempty"`
+	Mkfs   map[string]string `json:",omitempty"`
+	// mount options, and whether to mount read-only
+	MountOpts string `json:",omitempty"`
+	Readonly  bool   `json:",omitempty"`
+	Quota     bool   `json:",omitempty"` // user and group quotas
+	// root directory owner and permissions
+	UID         *int   `json:",omitempty"`
+	GID         *int   `json:",omitempty"`
+	Mode        string `json:",omitempty"`
+	UsernsRemap string `json:",omitempty"`
+	// SELinux label to mount with
+	SELinuxLabel string `json:",omitempty"`
+	// encryption key ID, if the volume is encrypted
+	KeyID string `json:",omitempty"`
+	// how to erase volume data on removal
+	SecureDelete string `json:",omitempty"`
+	// when the volume was last compacted (or tried to)
+	LastCompact time.Time
+}
+
+// loadMeta reads volume metadata. If there's none (e.g. the volume
+// was created by an older plugin version), empty metadata is returned.
+func (d *ploopDriver) loadMeta(name string) (*volumeMeta, error) {
+	var m volumeMeta
+
+	b, err := ioutil.ReadFile(d.meta(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &m, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// saveMeta writes volume metadata
+func (d *ploopDriver) saveMeta(name string, m *volumeMeta) error {
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	file := d.meta(name)
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-units"
+	"github.com/kolyshkin/goploop"
+)
+
+/* Inner filesystem options.
+ *
+ * libploop always creates ext4 with default parameters, so if any
+ * of the options below are given, the filesystem is re-created once
+ * the image is created.
+ */
+
+// Supported inner filesystems
+const (
+	fsExt4 = "ext4"
+	fsXFS  = "xfs"
+)
+
+// Volume options for the inner filesystem, and the filesystems
+// they are applicable to
+var mkfsOpts = map[string][]string{
+	"fstype":       {fsExt4, fsXFS},
+	"label":        {fsExt4, fsXFS},
+	"inode-ratio":  {fsExt4},
+	"inodes":       {fsExt4},
+	"reserved":     {fsExt4},
+	"journal-size": {fsExt4},
+	"fs-features":  {fsExt4},
+}
+
+// Maximum filesystem label lengths
+var maxLabel = map[string]int{
+	fsExt4: 16,
+	fsXFS:  12,
+}
+
+var fsFeaturesRe = regexp.MustCompile(`^\^?[a-z0-9_]+(,\^?[a-z0-9_]+)*$`)
+
+// mkfsOptions is a set of parsed inner filesystem options
+type mkfsOptions struct {
+	fstype string
+	args   []string          // mkfs arguments
+	given  map[string]string // options as given, to be saved
+}
+
+// baseMkfsArgs returns mkfs arguments to use for a filesystem
+func baseMkfsArgs(fstype string) []string {
+	if fstype == fsExt4 {
+		// same as libploop does
+		return []string{"-b", "4096", "-E", "lazy_itable_init=1,resize=4294967295"}
+	}
+
+	return []string{"-f"}
+}
+
+// parseMkfsOptions finds and validates inner filesystem options
+// among volume options
+func parseMkfsOptions(opts map[string]string) (*mkfsOptions, error) {
+	m := mkfsOptions{fstype: fsExt4, given: make(map[string]string)}
+	for k, v := range opts {
+		if _, ok := mkfsOpts[k]; ok {
+			m.given[k] = v
+		}
+	}
+	if len(m.given) == 0 {
+		return &m, nil
+	}
+
+	if v, ok := m.given["fstype"]; ok {
+		if v != fsExt4 && v != fsXFS {
+			return nil, fmt.Errorf("Can't parse fstype %s (use %s or %s)", v, fsExt4, fsXFS)
+		}
+		m.fstype = v
+	}
+	for k := range m.given {
+		ok := false
+		for _, fs := range mkfsOpts[k] {
+			ok = ok || fs == m.fstype
+		}
+		if !ok {
+			return nil, fmt.Errorf("Option %s is not supported for %s", k, m.fstype)
+		}
+	}
+	if _, ok := m.given["fstype"]; ok && m.fstype == fsExt4 && len(m.given) == 1 {
+		// nothing to change from what libploop does
+		return &m, nil
+	}
+	if _, err := exec.LookPath("mkfs." + m.fstype); err != nil {
+		return nil, fmt.Errorf("Filesystem %s is not supported: %s", m.fstype, err)
+	}
+
+	m.args = baseMkfsArgs(m.fstype)
+
+	if v, ok := m.given["label"]; ok {
+		if len(v) > maxLabel[m.fstype] {
+			return nil, fmt.Errorf("Label %s is too long (max %d characters for %s)", v, maxLabel[m.fstype], m.fstype)
+		}
+		m.args = append(m.args, "-L", v)
+	}
+	if v, ok := m.given["inode-ratio"]; ok {
+		n, err := units.RAMInBytes(v)
+		if err != nil || n < 1024 || n > 64<<20 {
+			return nil, fmt.Errorf("Can't parse inode-ratio %s (should be from 1K to 64M)", v)
+		}
+		m.args = append(m.args, "-i", strconv.FormatInt(n, 10))
+	}
+	if v, ok := m.given["inodes"]; ok {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("Can't parse inodes %s", v)
+		}
+		m.args = append(m.args, "-N", v)
+	}
+	if v, ok := m.given["reserved"]; ok {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || n < 0 || n > 50 {
+			return nil, fmt.Errorf("Can't parse reserved %s (should be a percentage from 0 to 50)", v)
+		}
+		m.args = append(m.args, "-m", v)
+	}
+	if v, ok := m.given["journal-size"]; ok {
+		n, err := units.RAMInBytes(v)
+		if err != nil || n < 4<<20 || n > 10<<30 {
+			return nil, fmt.Errorf("Can't parse journal-size %s (should be from 4M to 10G)", v)
+		}
+		m.args = append(m.args, "-J", fmt.Sprintf("size=%d", n>>20))
+	}
+	if v, ok := m.given["fs-features"]; ok {
+		if !fsFeaturesRe.MatchString(v) {
+			return nil, fmt.Errorf("Can't parse fs-features %s (use a comma separated list, like ^has_journal,quota)", v)
+		}
+		m.args = append(m.args, "-O", v)
+	}
+
+	return &m, nil
+}
+
+// mkfs re-creates the inner filesystem of a newly created volume
+func (d *ploopDriver) mkfs(o *op, name string, m *mkfsOptions) error {
+	p, err := ploop.Open(d.dd(name))
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	dev, err := p.Mount(&ploop.MountParam{})
+	if err != nil {
+		return err
+	}
+	defer p.Umount()
+
+	// the filesystem is on the first partition
+	return mkfsDev(o, dev+"p1", m)
+}
+
+// mkfsDev creates a filesystem on a device
+func mkfsDev(o *op, dev string, m *mkfsOptions) error {
+	args := m.args
+	if len(args) == 0 {
+		args = baseMkfsArgs(m.fstype)
+	}
+	o.log.Debugf("Creating %s filesystem on %s: %s", m.fstype, dev, strings.Join(args, " "))
+	if err := runCmd(nil, "mkfs."+m.fstype, append(args, dev)...); err != nil {
+		return err
+	}
+	if m.fstype == fsExt4 {
+		// same as libploop does
+		return runCmd(nil, "tune2fs", "-ouser_xattr,acl", "-c0", "-i0", dev)
+	}
+
+	return nil
+}
+
+// checkExt4 returns an error if the volume inner filesystem is not
+// ext4, which is required by some operations
+func (d *ploopDriver) checkExt4(name, what string) error {
+	m, err := d.loadMeta(name)
+	if err != nil {
+		return err
+	}
+	if m.FSType != "" && m.FSType != fsExt4 {
+		return fmt.Errorf("Can't %s volume %s: %s is not supported", what, name, m.FSType)
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakePath makes PATH only have a directory with the given (dummy)
+// commands, and returns a function to restore it
+func fakePath(t *testing.T, cmds ...string) func() {
+	dir, err := ioutil.TempDir("", "path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cmds {
+		if err := ioutil.WriteFile(path.Join(dir, c), []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := os.Getenv("PATH")
+	os.Setenv("PATH", dir)
+
+	return func() {
+		os.Setenv("PATH", old)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestParseMkfsOptions(t *testing.T) {
+	defer fakePath(t, "mkfs.ext4", "mkfs.xfs")()
+
+	ext4 := baseMkfsArgs(fsExt4)
+	xfs := baseMkfsArgs(fsXFS)
+	tests := []struct {
+		opts   map[string]string
+		fstype string
+		args   []string // nil means libploop defaults are fine
+		err    string
+	}{
+		{opts: nil, fstype: fsExt4},
+		{opts: map[string]string{"size": "10G"}, fstype: fsExt4},
+		{opts: map[string]string{"fstype": "ext4"}, fstype: fsExt4},
+		{opts: map[string]string{"fstype": "xfs"}, fstype: fsXFS, args: xfs},
+		{opts: map[string]string{"fstype": "btrfs"}, err: "Can't parse fstype btrfs"},
+		// a single option other than fstype must not be lost
+		{opts: map[string]string{"label": "data"}, fstype: fsExt4, args: append(ext4, "-L", "data")},
+		{opts: map[string]string{"inodes": "1000"}, fstype: fsExt4, args: append(ext4, "-N", "1000")},
+		{opts: map[string]string{"reserved": "0"}, fstype: fsExt4, args: append(ext4, "-m", "0")},
+		{opts: map[string]string{"inode-ratio": "64K"}, fstype: fsExt4, args: append(ext4, "-i", "65536")},
+		{opts: map[string]string{"journal-size": "128M"}, fstype: fsExt4, args: append(ext4, "-J", "size=128")},
+		{opts: map[string]string{"fs-features": "^has_journal,quota"}, fstype: fsExt4, args: append(ext4, "-O", "^has_journal,quota")},
+		{opts: map[string]string{"fstype": "ext4", "reserved": "1.5"}, fstype: fsExt4, args: append(ext4, "-m", "1.5")},
+		{opts: map[string]string{"fstype": "xfs", "label": "data"}, fstype: fsXFS, args: append(xfs, "-L", "data")},
+		{opts: map[string]string{"fstype": "xfs", "reserved": "0"}, err: "Option reserved is not supported for xfs"},
+		{opts: map[string]string{"label": "0123456789abcdef"}, fstype: fsExt4, args: append(ext4, "-L", "0123456789abcdef")},
+		{opts: map[string]string{"label": "0123456789abcdefg"}, err: "too long"},
+		{opts: map[string]string{"fstype": "xfs", "label": "0123456789abc"}, err: "too long"},
+		{opts: map[string]string{"inode-ratio": "512"}, err: "Can't parse inode-ratio"},
+		{opts: map[string]string{"inode-ratio": "128M"}, err: "Can't parse inode-ratio"},
+		{opts: map[string]string{"inodes": "0"}, err: "Can't parse inodes"},
+		{opts: map[string]string{"inodes": "-1"}, err: "Can't parse inodes"},
+		{opts: map[string]string{"inodes": "5000000000"}, err: "Can't parse inodes"},
+		{opts: map[string]string{"reserved": "51"}, err: "Can't parse reserved"},
+		{opts: map[string]string{"reserved": "x"}, err: "Can't parse reserved"},
+		{opts: map[string]string{"journal-size": "1M"}, err: "Can't parse journal-size"},
+		{opts: map[string]string{"journal-size": "11G"}, err: "Can't parse journal-size"},
+		{opts: map[string]string{"fs-features": "has journal"}, err: "Can't parse fs-features"},
+		{opts: map[string]string{"fs-features": "quota,"}, err: "Can't parse fs-features"},
+	}
+
+	for _, tc := range tests {
+		m, err := parseMkfsOptions(tc.opts)
+		if tc.err != "" {
+			if err == nil {
+				t.Errorf("%v: no error", tc.opts)
+			} else if !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%v: error %q, expected %q", tc.opts, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %s", tc.opts, err)
+			continue
+		}
+		if m.fstype != tc.fstype {
+			t.Errorf("%v: fstype %s, expected %s", tc.opts, m.fstype, tc.fstype)
+		}
+		if !reflect.DeepEqual(m.args, tc.args) {
+			t.Errorf("%v: args %q, expected %q", tc.opts, m.args, tc.args)
+		}
+		for k := range m.given {
+			if _, ok := mkfsOpts[k]; !ok {
+				t.Errorf("%v: non-mkfs option %s is saved", tc.opts, k)
+			}
+		}
+	}
+}
+
+func TestParseMkfsOptionsNoTool(t *testing.T) {
+	defer fakePath(t, "mkfs.ext4")()
+
+	if _, err := parseMkfsOptions(map[string]string{"fstype": "xfs"}); err == nil {
+		t.Error("no error without mkfs.xfs")
+	}
+	// libploop creates ext4 by itself
+	if _, err := parseMkfsOptions(map[string]string{"fstype": "ext4"}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// Mount options allowed, which are mount flags
+var mountFlags = map[string]int{
+	"noatime":    syscall.MS_NOATIME,
+	"nodiratime": syscall.MS_NODIRATIME,
+	"nosuid":     syscall.MS_NOSUID,
+	"nodev":      syscall.MS_NODEV,
+	"noexec":     syscall.MS_NOEXEC,
+}
+
+// Mount options allowed, which are passed to the filesystem,
+// and the filesystems they are applicable to
+var mountData = map[string][]string{
+	"discard":        {fsExt4, fsXFS},
+	"nobarrier":      {fsExt4},
+	"data=writeback": {fsExt4},
+	"data=ordered":   {fsExt4},
+	"data=journal":   {fsExt4},
+}
+
+// mountOptions is a set of parsed mount options
+type mountOptions struct {
+	flags int
+	data  string
+}
+
+// parseMountOpts parses a comma-separated list of mount options,
+// checking it against the allow-list for the given filesystem.
+// Unless strict is set, options not supported by the filesystem
+// are skipped.
+func parseMountOpts(str, fstype string, strict bool) (*mountOptions, error) {
+	var m mountOptions
+	var data []string
+
+	if str == "" {
+		return &m, nil
+	}
+	for _, opt := range strings.Split(str, ",") {
+		if opt == "defaults" {
+			continue
+		}
+		if f, ok := mountFlags[opt]; ok {
+			m.flags |= f
+			continue
+		}
+		fss, ok := mountData[opt]
+		if !ok {
+			return nil, fmt.Errorf("Mount option %s is not allowed", opt)
+		}
+		ok = false
+		for _, fs := range fss {
+			ok = ok || fs == fstype
+		}
+		if !ok {
+			if !strict {
+				continue
+			}
+			return nil, fmt.Errorf("Mount option %s is not supported for %s", opt, fstype)
+		}
+		data = append(data, opt)
+	}
+	m.data = strings.Join(data, ",")
+
+	return &m, nil
+}
+
+// addMountData appends an option to comma-separated mount data
+func addMountData(data, opt string) string {
+	if data == "" {
+		return opt
+	}
+
+	return data + "," + opt
+}
+
+// volumeFSType returns the volume inner filesystem type
+func volumeFSType(m *volumeMeta) string {
+	if m.FSType == "" {
+		return fsExt4
+	}
+
+	return m.FSType
+}
+
+// ploopMountable tells whether libploop can mount a volume filesystem
+// by itself, as it only knows about the unencrypted ext4 it creates
+func ploopMountable(m *volumeMeta) bool {
+	return m.KeyID == "" && volumeFSType(m) == fsExt4
+}
+
+// fsckArgs returns a command line to check a filesystem of a given
+// type on dev, and the highest exit code meaning it's fine
+func fsckArgs(fstype, dev string) ([]string, int) {
+	if fstype == fsXFS {
+		// xfs is repaired by log replay on mount, so only check it
+		return []string{"xfs_repair", "-n", dev}, 0
+	}
+
+	// exit code 1 means errors were fixed
+	return []string{"e2fsck", "-p", dev}, 1
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestParseMountOpts(t *testing.T) {
+	tests := []struct {
+		str    string
+		fstype string
+		strict bool
+		flags  int
+		data   string
+		err    string
+	}{
+		{str: "", fstype: fsExt4},
+		{str: "defaults", fstype: fsExt4},
+		{str: "noatime", fstype: fsExt4, flags: syscall.MS_NOATIME},
+		{str: "noatime,nodiratime,nosuid,nodev,noexec", fstype: fsXFS,
+			flags: syscall.MS_NOATIME | syscall.MS_NODIRATIME | syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC},
+		{str: "discard", fstype: fsExt4, data: "discard"},
+		{str: "discard", fstype: fsXFS, data: "discard"},
+		{str: "noatime,discard,data=writeback", fstype: fsExt4, flags: syscall.MS_NOATIME, data: "discard,data=writeback"},
+		{str: "defaults,nobarrier", fstype: fsExt4, strict: true, data: "nobarrier"},
+		// driver defaults not supported by a filesystem are skipped
+		{str: "noatime,nobarrier,discard", fstype: fsXFS, flags: syscall.MS_NOATIME, data: "discard"},
+		{str: "data=journal", fstype: fsXFS},
+		// unless given for a particular volume
+		{str: "noatime,nobarrier", fstype: fsXFS, strict: true, err: "Mount option nobarrier is not supported for xfs"},
+		// options not allowed are never skipped
+		{str: "noatime,suid", fstype: fsExt4, err: "Mount option suid is not allowed"},
+		{str: "context=foo", fstype: fsExt4, err: "not allowed"},
+		{str: "data=bogus", fstype: fsExt4, err: "not allowed"},
+		{str: "noatime,", fstype: fsExt4, err: "Mount option  is not allowed"},
+		{str: "NOATIME", fstype: fsExt4, err: "not allowed"},
+	}
+
+	for _, tc := range tests {
+		m, err := parseMountOpts(tc.str, tc.fstype, tc.strict)
+		if tc.err != "" {
+			if err == nil {
+				t.Errorf("%q (%s): no error", tc.str, tc.fstype)
+			} else if !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%q (%s): error %q, expected %q", tc.str, tc.fstype, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q (%s): unexpected error: %s", tc.str, tc.fstype, err)
+			continue
+		}
+		if m.flags != tc.flags {
+			t.Errorf("%q (%s): flags %#x, expected %#x", tc.str, tc.fstype, m.flags, tc.flags)
+		}
+		if m.data != tc.data {
+			t.Errorf("%q (%s): data %q, expected %q", tc.str, tc.fstype, m.data, tc.data)
+		}
+	}
+}
+
+func TestAddMountData(t *testing.T) {
+	tests := []struct {
+		data, opt, out string
+	}{
+		{"", "discard", "discard"},
+		{"discard", "uquota,gquota", "discard,uquota,gquota"},
+	}
+
+	for _, tc := range tests {
+		if out := addMountData(tc.data, tc.opt); out != tc.out {
+			t.Errorf("%q + %q: %q, expected %q", tc.data, tc.opt, out, tc.out)
+		}
+	}
+}
+
+func TestPloopMountable(t *testing.T) {
+	tests := []struct {
+		meta volumeMeta
+		ok   bool
+	}{
+		{meta: volumeMeta{}, ok: true},
+		{meta: volumeMeta{FSType: fsExt4}, ok: true},
+		{meta: volumeMeta{FSType: fsXFS}},
+		{meta: volumeMeta{KeyID: "key"}},
+		{meta: volumeMeta{FSType: fsXFS, KeyID: "key"}},
+	}
+
+	for _, tc := range tests {
+		if ok := ploopMountable(&tc.meta); ok != tc.ok {
+			t.Errorf("%+v: %v, expected %v", tc.meta, ok, tc.ok)
+		}
+	}
+}
+
+func TestFsckArgs(t *testing.T) {
+	tests := []struct {
+		fstype  string
+		args    []string
+		maxCode int
+	}{
+		{fstype: fsExt4, args: []string{"e2fsck", "-p", "/dev/ploop1p1"}, maxCode: 1},
+		{fstype: fsXFS, args: []string{"xfs_repair", "-n", "/dev/ploop1p1"}, maxCode: 0},
+	}
+
+	for _, tc := range tests {
+		args, maxCode := fsckArgs(tc.fstype, "/dev/ploop1p1")
+		if !reflect.DeepEqual(args, tc.args) || maxCode != tc.maxCode {
+			t.Errorf("%s: %q %d, expected %q %d", tc.fstype, args, maxCode, tc.args, tc.maxCode)
+		}
+	}
+}
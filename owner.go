@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/kolyshkin/goploop"
+)
+
+/* Ownership and permissions of the volume root directory.
+ *
+ * With Docker user namespace remapping (dockerd --userns-remap), root
+ * and other users inside containers are mapped to unprivileged host
+ * IDs, taken from /etc/subuid and /etc/subgid. If the userns-remap
+ * option is set to the same user as for dockerd, the uid and gid
+ * given are shifted accordingly, so they are the same as seen from
+ * inside containers.
+ */
+
+// Files with subordinate ID ranges
+const (
+	subuidFile = "/etc/subuid"
+	subgidFile = "/etc/subgid"
+)
+
+// User dockerd creates for --userns-remap=default
+const defaultRemapUser = "dockremap"
+
+// idRange is a range of subordinate IDs
+type idRange struct {
+	start, count uint64
+}
+
+// ownerOptions is the desired ownership and permissions
+// of a volume root directory
+type ownerOptions struct {
+	uid, gid    int    // -1: don't change
+	mode        uint32 // 0: don't change
+	usernsRemap string // userns-remap user[:group], or empty
+}
+
+// ownerKeys are volume options related to ownership
+var ownerKeys = []string{"uid", "gid", "mode", "userns-remap"}
+
+// parseOwner parses ownership options (a subset of ownerKeys)
+func parseOwner(opts map[string]string) (*ownerOptions, error) {
+	o := ownerOptions{uid: -1, gid: -1}
+
+	for _, k := range []string{"uid", "gid"} {
+		str, ok := opts[k]
+		if !ok || str == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(str, 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("Can't parse %s %s", k, str)
+		}
+		if k == "uid" {
+			o.uid = int(id)
+		} else {
+			o.gid = int(id)
+		}
+	}
+	if str, ok := opts["mode"]; ok && str != "" {
+		mode, err := strconv.ParseUint(str, 8, 32)
+		if err != nil || mode == 0 || mode > 07777 {
+			return nil, fmt.Errorf("Can't parse mode %s (use octal permissions, like 0775)", str)
+		}
+		o.mode = uint32(mode)
+	}
+	if str, ok := opts["userns-remap"]; ok {
+		if _, _, err := remapNames(str); err != nil {
+			return nil, err
+		}
+		o.usernsRemap = str
+	}
+
+	return &o, nil
+}
+
+// remapNames returns user and group names for userns-remap value,
+// the same way dockerd does it
+func remapNames(str string) (string, string, error) {
+	if str == "" {
+		return "", "", nil
+	}
+	if str == "default" {
+		return defaultRemapUser, defaultRemapUser, nil
+	}
+	s := strings.SplitN(str, ":", 2)
+	if s[0] == "" || (len(s) == 2 && s[1] == "") {
+		return "", "", fmt.Errorf("Can't parse userns-remap %s (use USER[:GROUP], or default)", str)
+	}
+	if len(s) == 1 {
+		return s[0], s[0], nil
+	}
+
+	return s[0], s[1], nil
+}
+
+// subIDRanges reads subordinate ID ranges for a name (or a numeric ID)
+// from /etc/subuid or /etc/subgid
+func subIDRanges(file, name, id string) ([]idRange, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ranges []idRange
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		l := strings.Split(strings.TrimSpace(s.Text()), ":")
+		if len(l) != 3 || (l[0] != name && l[0] != id) {
+			continue
+		}
+		start, err1 := strconv.ParseUint(l[1], 10, 32)
+		count, err2 := strconv.ParseUint(l[2], 10, 32)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("Can't parse %s line %q", file, s.Text())
+		}
+		ranges = append(ranges, idRange{start, count})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("No subordinate ID ranges for %s in %s", name, file)
+	}
+
+	return ranges, nil
+}
+
+// remapID maps a container ID to a host ID, using subordinate ID
+// ranges in order, like dockerd does
+func remapID(ranges []idRange, id int) (int, error) {
+	n := uint64(id)
+	for _, r := range ranges {
+		if n < r.count {
+			return int(r.start + n), nil
+		}
+		n -= r.count
+	}
+
+	return 0, fmt.Errorf("ID %d is out of subordinate ID ranges", id)
+}
+
+// hostIDs returns host uid and gid for the root directory,
+// remapped if needed
+func (oo *ownerOptions) hostIDs() (int, int, error) {
+	uid, gid := oo.uid, oo.gid
+	if oo.usernsRemap == "" {
+		return uid, gid, nil
+	}
+
+	uname, gname, err := remapNames(oo.usernsRemap)
+	if err != nil {
+		return 0, 0, err
+	}
+	// root inside a container is not root on the host
+	if uid == -1 {
+		uid = 0
+	}
+	if gid == -1 {
+		gid = 0
+	}
+
+	var uidStr, gidStr string
+	if u, err := user.Lookup(uname); err == nil {
+		uidStr = u.Uid
+	}
+	if g, err := user.LookupGroup(gname); err == nil {
+		gidStr = g.Gid
+	}
+	uranges, err := subIDRanges(subuidFile, uname, uidStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	granges, err := subIDRanges(subgidFile, gname, gidStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	if uid, err = remapID(uranges, uid); err != nil {
+		return 0, 0, err
+	}
+	if gid, err = remapID(granges, gid); err != nil {
+		return 0, 0, err
+	}
+
+	return uid, gid, nil
+}
+
+// setOwner records volume root ownership options in metadata
+func (m *volumeMeta) setOwner(oo *ownerOptions) {
+	m.UID, m.GID, m.Mode = nil, nil, ""
+	if oo.uid != -1 {
+		uid := oo.uid
+		m.UID = &uid
+	}
+	if oo.gid != -1 {
+		gid := oo.gid
+		m.GID = &gid
+	}
+	if oo.mode != 0 {
+		m.Mode = fmt.Sprintf("%04o", oo.mode)
+	}
+	m.UsernsRemap = oo.usernsRemap
+}
+
+// isSet returns true if ownership or permissions are to be changed
+func (oo *ownerOptions) isSet() bool {
+	return oo.uid != -1 || oo.gid != -1 || oo.mode != 0 || oo.usernsRemap != ""
+}
+
+// applyOwner changes ownership and permissions of a volume root
+// directory. An unmounted volume is mounted for the time being.
+func (d *ploopDriver) applyOwner(o *op, name string, meta *volumeMeta, oo *ownerOptions) error {
+	uid, gid, err := oo.hostIDs()
+	if err != nil {
+		return err
+	}
+
+	p, err := ploop.Open(d.dd(name))
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	mnt := d.mnt(name)
+	if m, _ := p.IsMounted(); !m {
+		if err := os.Mkdir(mnt, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+		if _, err := d.mountFS(o, p, name, meta, &ploop.MountParam{Target: mnt}); err != nil {
+			return err
+		}
+		defer d.umountFS(o, p, name, meta)
+	}
+
+	if uid != -1 || gid != -1 {
+		o.log.Debugf("Changing root owner to %d:%d", uid, gid)
+		if err := os.Chown(mnt, uid, gid); err != nil {
+			return err
+		}
+	}
+	if oo.mode != 0 {
+		o.log.Debugf("Changing root mode to %04o", oo.mode)
+		// os.Chmod would lose setuid, setgid and sticky bits
+		mode := os.FileMode(oo.mode & 0777)
+		if oo.mode&04000 != 0 {
+			mode |= os.ModeSetuid
+		}
+		if oo.mode&02000 != 0 {
+			mode |= os.ModeSetgid
+		}
+		if oo.mode&01000 != 0 {
+			mode |= os.ModeSticky
+		}
+		if err := os.Chmod(mnt, mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setOwner changes and records volume root ownership and permissions
+func (d *ploopDriver) setOwner(o *op, name string, opts map[string]string) error {
+	if err := d.checkBroken(o, name); err != nil {
+		return err
+	}
+	m, err := d.loadMeta(name)
+	if err != nil {
+		return err
+	}
+
+	// Options not given are kept as they are
+	cur := map[string]string{"userns-remap": m.UsernsRemap, "mode": m.Mode}
+	if m.UID != nil {
+		cur["uid"] = strconv.Itoa(*m.UID)
+	}
+	if m.GID != nil {
+		cur["gid"] = strconv.Itoa(*m.GID)
+	}
+	for k, v := range opts {
+		cur[k] = v
+	}
+	oo, err := parseOwner(cur)
+	if err != nil {
+		return err
+	}
+
+	if err := d.applyOwner(o, name, m, oo); err != nil {
+		return err
+	}
+	m.setOwner(oo)
+
+	return d.saveMeta(name, m)
+}
+
+// adminSetOwner changes volume root ownership and permissions
+func (d *ploopDriver) adminSetOwner(r *http.Request) (interface{}, error) {
+	name := r.FormValue("volume")
+	if name == "" {
+		return nil, fmt.Errorf("Volume name is required")
+	}
+	if err := d.findVol(name); err != nil {
+		return nil, err
+	}
+	opts := make(map[string]string)
+	for _, k := range ownerKeys {
+		if v, ok := r.Form[k]; ok {
+			opts[k] = v[0]
+		}
+	}
+	if len(opts) == 0 {
+		return nil, fmt.Errorf("Nothing to change")
+	}
+
+	o := newOp("set-owner", name)
+	err := d.runTimeout(o, opts, 0, func() error {
+		return d.setOwner(o, name, opts)
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return struct{}{}, nil
+}
+
+func cmdSetOwner(args []string) error {
+	fs := flag.NewFlagSet("set-owner", flag.ExitOnError)
+	fs.String("uid", "", "Owner user ID")
+	fs.String("gid", "", "Owner group ID")
+	fs.String("mode", "", "Permissions, in octal")
+	fs.String("userns-remap", "", "Docker userns-remap USER[:GROUP] to shift IDs by (empty to not shift)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("Usage: set-owner [-uid UID] [-gid GID] [-mode MODE] [-userns-remap USER] VOLUME")
+	}
+
+	q := url.Values{}
+	q.Set("volume", fs.Arg(0))
+	// only pass the flags which were given
+	fs.Visit(func(f *flag.Flag) {
+		q.Set(f.Name, f.Value.String())
+	})
+
+	var out struct{}
+	return adminCall("POST", "/set-owner?"+q.Encode(), nil, &out)
+}
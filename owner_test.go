@@ -0,0 +1,186 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseOwner(t *testing.T) {
+	tests := []struct {
+		opts map[string]string
+		oo   ownerOptions
+		err  string
+	}{
+		{opts: nil, oo: ownerOptions{uid: -1, gid: -1}},
+		{opts: map[string]string{"uid": "", "gid": "", "mode": ""}, oo: ownerOptions{uid: -1, gid: -1}},
+		{opts: map[string]string{"uid": "0"}, oo: ownerOptions{uid: 0, gid: -1}},
+		{opts: map[string]string{"uid": "1000", "gid": "100"}, oo: ownerOptions{uid: 1000, gid: 100}},
+		{opts: map[string]string{"uid": "2147483647"}, oo: ownerOptions{uid: 2147483647, gid: -1}},
+		{opts: map[string]string{"mode": "0770"}, oo: ownerOptions{uid: -1, gid: -1, mode: 0770}},
+		{opts: map[string]string{"mode": "1777"}, oo: ownerOptions{uid: -1, gid: -1, mode: 01777}},
+		{opts: map[string]string{"userns-remap": "default"}, oo: ownerOptions{uid: -1, gid: -1, usernsRemap: "default"}},
+		{opts: map[string]string{"uid": "-1"}, err: "Can't parse uid -1"},
+		{opts: map[string]string{"gid": "2147483648"}, err: "Can't parse gid"},
+		{opts: map[string]string{"uid": "root"}, err: "Can't parse uid"},
+		{opts: map[string]string{"mode": "0"}, err: "Can't parse mode"},
+		{opts: map[string]string{"mode": "0789"}, err: "Can't parse mode"},
+		{opts: map[string]string{"mode": "10000"}, err: "Can't parse mode"},
+		{opts: map[string]string{"mode": "rwx"}, err: "Can't parse mode"},
+		{opts: map[string]string{"userns-remap": ":docker"}, err: "Can't parse userns-remap"},
+	}
+
+	for _, tc := range tests {
+		oo, err := parseOwner(tc.opts)
+		if tc.err != "" {
+			if err == nil {
+				t.Errorf("%v: no error", tc.opts)
+			} else if !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%v: error %q, expected %q", tc.opts, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %s", tc.opts, err)
+			continue
+		}
+		if *oo != tc.oo {
+			t.Errorf("%v: got %+v, expected %+v", tc.opts, *oo, tc.oo)
+		}
+		if oo.isSet() != (tc.oo != ownerOptions{uid: -1, gid: -1}) {
+			t.Errorf("%v: isSet %v", tc.opts, oo.isSet())
+		}
+	}
+}
+
+func TestRemapNames(t *testing.T) {
+	tests := []struct {
+		str, user, group string
+		err              bool
+	}{
+		{str: ""},
+		{str: "default", user: defaultRemapUser, group: defaultRemapUser},
+		{str: "docker", user: "docker", group: "docker"},
+		{str: "docker:users", user: "docker", group: "users"},
+		{str: "1000:1000", user: "1000", group: "1000"},
+		{str: ":users", err: true},
+		{str: "docker:", err: true},
+		{str: ":", err: true},
+	}
+
+	for _, tc := range tests {
+		u, g, err := remapNames(tc.str)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: no error", tc.str)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", tc.str, err)
+		} else if u != tc.user || g != tc.group {
+			t.Errorf("%q: %q:%q, expected %q:%q", tc.str, u, g, tc.user, tc.group)
+		}
+	}
+}
+
+func TestSubIDRanges(t *testing.T) {
+	f, err := ioutil.TempFile("", "subuid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`# comment
+dockremap:100000:65536
+other:200000:65536
+ dockremap:300000:1000
+1001:400000:10
+broken:x:10
+`)
+	f.Close()
+
+	tests := []struct {
+		name, id string
+		ranges   []idRange
+		err      string
+	}{
+		{name: "dockremap", ranges: []idRange{{100000, 65536}, {300000, 1000}}},
+		{name: "other", id: "1000", ranges: []idRange{{200000, 65536}}},
+		// by numeric ID, if there's no entry for the name
+		{name: "user", id: "1001", ranges: []idRange{{400000, 10}}},
+		{name: "nobody", id: "65534", err: "No subordinate ID ranges for nobody"},
+		{name: "broken", err: "Can't parse"},
+	}
+
+	for _, tc := range tests {
+		ranges, err := subIDRanges(f.Name(), tc.name, tc.id)
+		if tc.err != "" {
+			if err == nil {
+				t.Errorf("%s: no error", tc.name)
+			} else if !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: error %q, expected %q", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.name, err)
+		} else if !reflect.DeepEqual(ranges, tc.ranges) {
+			t.Errorf("%s: %v, expected %v", tc.name, ranges, tc.ranges)
+		}
+	}
+
+	if _, err := subIDRanges(f.Name()+".nonexistent", "dockremap", ""); err == nil {
+		t.Error("no error for a nonexistent file")
+	}
+}
+
+func TestRemapID(t *testing.T) {
+	ranges := []idRange{{100000, 1000}, {300000, 10}}
+	tests := []struct {
+		id, host int
+		err      bool
+	}{
+		{id: 0, host: 100000},
+		{id: 999, host: 100999},
+		// the next range continues where the previous one ends
+		{id: 1000, host: 300000},
+		{id: 1009, host: 300009},
+		{id: 1010, err: true},
+	}
+
+	for _, tc := range tests {
+		host, err := remapID(ranges, tc.id)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%d: no error", tc.id)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: unexpected error: %s", tc.id, err)
+		} else if host != tc.host {
+			t.Errorf("%d: %d, expected %d", tc.id, host, tc.host)
+		}
+	}
+
+	if _, err := remapID(nil, 0); err == nil {
+		t.Error("no error without ranges")
+	}
+}
+
+func TestSetOwner(t *testing.T) {
+	var m volumeMeta
+
+	m.setOwner(&ownerOptions{uid: 1000, gid: -1, mode: 0750, usernsRemap: "default"})
+	if m.UID == nil || *m.UID != 1000 || m.GID != nil || m.Mode != "0750" || m.UsernsRemap != "default" {
+		t.Errorf("unexpected %+v", m)
+	}
+
+	// unset options are cleared
+	m.setOwner(&ownerOptions{uid: -1, gid: 0})
+	if m.UID != nil || m.GID == nil || *m.GID != 0 || m.Mode != "" || m.UsernsRemap != "" {
+		t.Errorf("unexpected %+v", m)
+	}
+}
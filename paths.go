@@ -5,6 +5,8 @@ import "path"
 const (
 	ddxml       = "DiskDescriptor.xml"
 	imagePrefix = "root.hdd"
+	metaFile    = "volume.json"
+	dirtyFile   = ".mounted"
 )
 
 // Returns path to ploop image directory for given id
@@ -23,7 +25,32 @@ func (d *ploopDriver) img(id string) string {
 	return path.Join(d.dir(id), imagePrefix)
 }
 
+// Returns path to volume metadata for given id
+func (d *ploopDriver) meta(id string) string {
+	return path.Join(d.dir(id), metaFile)
+}
+
+// Returns path to a file which exists while the volume is mounted
+func (d *ploopDriver) dirtyMark(id string) string {
+	return path.Join(d.dir(id), dirtyFile)
+}
+
 // Returns a mount point for given id
 func (d *ploopDriver) mnt(id string) string {
 	return path.Join(d.home, "mnt", id)
 }
+
+// Returns path to a journal record for given id
+func (d *ploopDriver) journal(id string) string {
+	return path.Join(d.home, "journal", id)
+}
+
+// Returns path to a quarantined volume directory for given id
+func (d *ploopDriver) quarantined(id string) string {
+	return path.Join(d.home, "quarantine", id)
+}
+
+// Returns path to a directory of a removed volume being erased
+func (d *ploopDriver) erasing(id string) string {
+	return path.Join(d.home, "erase", id)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/kolyshkin/docker-volume-ploop/diskdescriptor"
+)
+
+// Volume status key for the reason the volume is broken
+const statusBroken = "Broken"
+
+// brokenVolume describes a volume which can't be used
+type brokenVolume struct {
+	Volume string
+	Reason string
+}
+
+// isCreating checks whether the volume is being created right now
+func isCreating(name string) bool {
+	for _, o := range inFlight() {
+		if o.name == "create" && o.vol == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// lostDD checks whether a volume directory exists and has some files
+// in it, but no DiskDescriptor.xml
+func (d *ploopDriver) lostDD(name string) bool {
+	if exist, _ := d.volExist(name); exist {
+		return false
+	}
+	files, err := ioutil.ReadDir(d.dir(name))
+
+	return err == nil && len(files) > 0
+}
+
+// isVolume checks whether a directory under img is a volume, either
+// a good or a broken one. A volume being created is not there yet.
+func (d *ploopDriver) isVolume(name string) bool {
+	if exist, _ := d.volExist(name); exist {
+		return true
+	}
+
+	return d.lostDD(name) && !isCreating(name)
+}
+
+// brokenReason checks whether a volume is broken, i.e. can't be used
+// since its DiskDescriptor.xml or image files are missing or corrupt.
+// Returns the reason, or an empty string if the volume is fine.
+func (d *ploopDriver) brokenReason(name string) string {
+	desc, err := diskdescriptor.Read(d.dd(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Sprintf("%s is missing", ddxml)
+		}
+		return fmt.Sprintf("Bad %s: %s", ddxml, err)
+	}
+	for _, f := range desc.Files() {
+		if _, err := os.Stat(f); err != nil {
+			return fmt.Sprintf("Bad image file: %s", err)
+		}
+	}
+
+	return ""
+}
+
+// checkBroken returns an error if the volume is broken
+func (d *ploopDriver) checkBroken(o *op, name string) error {
+	reason := d.brokenReason(name)
+	if reason == "" {
+		return nil
+	}
+
+	o.log.Warnf("Volume is broken: %s", reason)
+	return fmt.Errorf("Volume %s is broken (%s), see docker-volume-ploop broken", name, reason)
+}
+
+// brokenVolumes returns the list of broken volumes
+func (d *ploopDriver) brokenVolumes() ([]brokenVolume, error) {
+	vols, err := d.list()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]brokenVolume, 0)
+	for _, v := range vols {
+		if reason, ok := v.Status[statusBroken].(string); ok {
+			list = append(list, brokenVolume{Volume: v.Name, Reason: reason})
+		}
+	}
+
+	return list, nil
+}
+
+// quarantine moves a broken volume out of the way, to a directory
+// where it can be investigated
+func (d *ploopDriver) quarantine(o *op, name string) (string, error) {
+	if d.brokenReason(name) == "" {
+		return "", fmt.Errorf("Volume %s is not broken", name)
+	}
+
+	mnts, err := d.mountedVolumes()
+	if err != nil {
+		return "", err
+	}
+	for _, m := range mnts {
+		if m == name {
+			return "", fmt.Errorf("Volume %s is mounted", name)
+		}
+	}
+
+	if err := os.MkdirAll(d.quarantined(""), 0700); err != nil {
+		return "", err
+	}
+	dst := d.quarantined(fmt.Sprintf("%s-%s", name, time.Now().Format("20060102-150405")))
+	if err := os.Rename(d.dir(name), dst); err != nil {
+		return "", err
+	}
+	o.log.Infof("Volume moved to %s", dst)
+	os.Remove(d.mnt(name))
+
+	return dst, nil
+}
+
+// adminBroken lists broken volumes
+func (d *ploopDriver) adminBroken(r *http.Request) (interface{}, error) {
+	return d.brokenVolumes()
+}
+
+// adminQuarantine moves a broken volume to quarantine
+func (d *ploopDriver) adminQuarantine(r *http.Request) (interface{}, error) {
+	var dst string
+
+	name := r.FormValue("volume")
+	if name == "" {
+		return nil, fmt.Errorf("Volume name is required")
+	}
+	// Broken volumes might not be found, but the name is still
+	// used as a path
+	if err := checkVolName(name); err != nil {
+		return nil, err
+	}
+	o := newOp("quarantine", name)
+	err := d.runAdmin(o, func() (err error) {
+		dst, err = d.quarantine(o, name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return struct{ Path string }{dst}, nil
+}
+
+func cmdBroken(args []string) error {
+	var list []brokenVolume
+	if err := adminCall("GET", "/broken", nil, &list); err != nil {
+		return err
+	}
+
+	return printJSON(list)
+}
+
+func cmdQuarantine(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: quarantine VOLUME")
+	}
+
+	var out struct{ Path string }
+	if err := adminCall("POST", "/quarantine?volume="+url.QueryEscape(args[0]), nil, &out); err != nil {
+		return err
+	}
+	fmt.Printf("Volume %s moved to %s\n", args[0], out.Path)
+
+	return nil
+}
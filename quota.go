@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-units"
+	"github.com/kolyshkin/goploop"
+)
+
+/* User and group quotas inside a volume.
+ *
+ * A volume created with quota=on is mounted with quotas enabled
+ * (by libploop for ext4, or by uquota,gquota options for xfs).
+ * Limits are set and reported by the quota tools, so they should
+ * be installed.
+ */
+
+// Quota types
+const (
+	quotaUser  = "user"
+	quotaGroup = "group"
+)
+
+// quotaEntry is a quota usage and limits of a user or a group.
+// Block limits are in bytes; zero limit means no limit.
+type quotaEntry struct {
+	Type       string
+	ID         uint32
+	BlocksUsed uint64
+	BlocksSoft uint64
+	BlocksHard uint64
+	InodesUsed uint64
+	InodesSoft uint64
+	InodesHard uint64
+}
+
+// quotaFlag returns a quota tools flag for a quota type
+func quotaFlag(typ string) (string, error) {
+	switch typ {
+	case quotaUser:
+		return "-u", nil
+	case quotaGroup:
+		return "-g", nil
+	}
+
+	return "", fmt.Errorf("Invalid quota type %s (use user or group)", typ)
+}
+
+// quotaMount returns the mount point of a volume with quotas
+// enabled, or an error
+func (d *ploopDriver) quotaMount(name string) (string, error) {
+	m, err := d.loadMeta(name)
+	if err != nil {
+		return "", err
+	}
+	if !m.Quota {
+		return "", fmt.Errorf("Volume %s has no quota enabled", name)
+	}
+
+	p, err := ploop.Open(d.dd(name))
+	if err != nil {
+		return "", err
+	}
+	defer p.Close()
+	if mounted, _ := p.IsMounted(); !mounted {
+		return "", fmt.Errorf("Volume %s is not mounted", name)
+	}
+
+	return d.mnt(name), nil
+}
+
+// quotaOn initializes and turns on quotas on a freshly mounted
+// ext4 volume. Failure to turn quotas on is not fatal, as they
+// might be turned on already.
+func (d *ploopDriver) quotaOn(o *op, mnt string) error {
+	if _, err := os.Stat(path.Join(mnt, "aquota.user")); os.IsNotExist(err) {
+		o.log.Infof("Initializing quota files")
+		if err := runCmd(nil, "quotacheck", "-cugm", mnt); err != nil {
+			return err
+		}
+	}
+	if err := runCmd(nil, "quotaon", "-ug", mnt); err != nil {
+		o.log.Debugf("Can't turn quota on: %s", err)
+	}
+
+	return nil
+}
+
+// quotaReport reports quotas of all users or groups of a volume
+func (d *ploopDriver) quotaReport(name, typ string) ([]quotaEntry, error) {
+	flg, err := quotaFlag(typ)
+	if err != nil {
+		return nil, err
+	}
+	mnt, err := d.quotaMount(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	if err := runCmd(&out, "repquota", flg, "-n", "-p", mnt); err != nil {
+		return nil, err
+	}
+
+	return parseRepquota(&out, typ)
+}
+
+// parseRepquota parses repquota -n -p output of a given quota type
+func parseRepquota(r io.Reader, typ string) ([]quotaEntry, error) {
+	// Entry lines look like (block numbers are in KB):
+	// #ID  FLAGS  BUSED BSOFT BHARD BGRACE  IUSED ISOFT IHARD IGRACE
+	var list []quotaEntry
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) < 9 || !strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		id, err := strconv.ParseUint(f[0][1:], 10, 32)
+		if err != nil {
+			continue
+		}
+		var n [6]uint64
+		for i, j := range []int{2, 3, 4, 6, 7, 8} {
+			if n[i], err = strconv.ParseUint(f[j], 10, 64); err != nil {
+				return nil, fmt.Errorf("Can't parse repquota output: %q", s.Text())
+			}
+		}
+		list = append(list, quotaEntry{
+			Type:       typ,
+			ID:         uint32(id),
+			BlocksUsed: n[0] << 10,
+			BlocksSoft: n[1] << 10,
+			BlocksHard: n[2] << 10,
+			InodesUsed: n[3],
+			InodesSoft: n[4],
+			InodesHard: n[5],
+		})
+	}
+
+	return list, s.Err()
+}
+
+// setQuota sets quota limits for a user or a group on a volume
+func (d *ploopDriver) setQuota(o *op, name string, q *quotaEntry) error {
+	flg, err := quotaFlag(q.Type)
+	if err != nil {
+		return err
+	}
+	mnt, err := d.quotaMount(name)
+	if err != nil {
+		return err
+	}
+
+	o.log.Infof("Setting %s %d quota", q.Type, q.ID)
+	return runCmd(nil, "setquota", flg, strconv.FormatUint(uint64(q.ID), 10),
+		strconv.FormatUint(q.BlocksSoft>>10, 10), strconv.FormatUint(q.BlocksHard>>10, 10),
+		strconv.FormatUint(q.InodesSoft, 10), strconv.FormatUint(q.InodesHard, 10), mnt)
+}
+
+// parseLimit parses a quota limit, which is either a size or a number
+func parseLimit(str string, size bool) (uint64, error) {
+	if str == "" {
+		return 0, nil
+	}
+	if size {
+		n, err := units.RAMInBytes(str)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("Can't parse limit %s", str)
+		}
+		return uint64(n), nil
+	}
+
+	n, err := strconv.ParseUint(str, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Can't parse limit %s", str)
+	}
+	return n, nil
+}
+
+// adminQuota reports volume quotas
+func (d *ploopDriver) adminQuota(r *http.Request) (interface{}, error) {
+	var list []quotaEntry
+
+	name := r.FormValue("volume")
+	if name == "" {
+		return nil, fmt.Errorf("Volume name is required")
+	}
+	if err := d.findVol(name); err != nil {
+		return nil, err
+	}
+	types := []string{quotaUser, quotaGroup}
+	if typ := r.FormValue("type"); typ != "" {
+		types = []string{typ}
+	}
+
+	o := newOp("quota", name)
+	err := d.runAdmin(o, func() error {
+		for _, typ := range types {
+			l, err := d.quotaReport(name, typ)
+			if err != nil {
+				return err
+			}
+			list = append(list, l...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// adminSetQuota sets quota limits of a user or a group
+func (d *ploopDriver) adminSetQuota(r *http.Request) (interface{}, error) {
+	var err error
+
+	name := r.FormValue("volume")
+	if name == "" {
+		return nil, fmt.Errorf("Volume name is required")
+	}
+	if err := d.findVol(name); err != nil {
+		return nil, err
+	}
+
+	q := quotaEntry{Type: r.FormValue("type")}
+	if q.Type == "" {
+		q.Type = quotaUser
+	}
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Can't parse id %s", r.FormValue("id"))
+	}
+	q.ID = uint32(id)
+	if q.BlocksSoft, err = parseLimit(r.FormValue("block-soft"), true); err != nil {
+		return nil, err
+	}
+	if q.BlocksHard, err = parseLimit(r.FormValue("block-hard"), true); err != nil {
+		return nil, err
+	}
+	if q.InodesSoft, err = parseLimit(r.FormValue("inode-soft"), false); err != nil {
+		return nil, err
+	}
+	if q.InodesHard, err = parseLimit(r.FormValue("inode-hard"), false); err != nil {
+		return nil, err
+	}
+
+	opts := map[string]string{"type": q.Type, "id": r.FormValue("id")}
+	for _, k := range []string{"block-soft", "block-hard", "inode-soft", "inode-hard"} {
+		opts[k] = r.FormValue(k)
+	}
+	o := newOp("set-quota", name)
+	err = d.runTimeout(o, opts, 0, func() error {
+		return d.setQuota(o, name, &q)
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return struct{}{}, nil
+}
+
+func cmdQuota(args []string) error {
+	fs := flag.NewFlagSet("quota", flag.ExitOnError)
+	group := fs.Bool("group", false, "Show group quotas only")
+	user := fs.Bool("user", false, "Show user quotas only")
+	fs.Parse(args)
+	if fs.NArg() != 1 || (*group && *user) {
+		return fmt.Errorf("Usage: quota [-user|-group] VOLUME")
+	}
+
+	q := url.Values{}
+	q.Set("volume", fs.Arg(0))
+	if *user {
+		q.Set("type", quotaUser)
+	} else if *group {
+		q.Set("type", quotaGroup)
+	}
+
+	var list []quotaEntry
+	if err := adminCall("GET", "/quota?"+q.Encode(), nil, &list); err != nil {
+		return err
+	}
+
+	return printJSON(list)
+}
+
+func cmdSetQuota(args []string) error {
+	fs := flag.NewFlagSet("set-quota", flag.ExitOnError)
+	group := fs.Bool("group", false, "ID is a group ID")
+	fs.Parse(args)
+	if fs.NArg() != 6 {
+		return fmt.Errorf("Usage: set-quota [-group] VOLUME ID BLOCK-SOFT BLOCK-HARD INODE-SOFT INODE-HARD")
+	}
+
+	q := url.Values{}
+	q.Set("volume", fs.Arg(0))
+	q.Set("type", quotaUser)
+	if *group {
+		q.Set("type", quotaGroup)
+	}
+	q.Set("id", fs.Arg(1))
+	q.Set("block-soft", fs.Arg(2))
+	q.Set("block-hard", fs.Arg(3))
+	q.Set("inode-soft", fs.Arg(4))
+	q.Set("inode-hard", fs.Arg(5))
+
+	var out struct{}
+	return adminCall("POST", "/set-quota?"+q.Encode(), nil, &out)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// repquota -n -p output, with a user over its soft block limit
+const repquotaOut = `*** Report for user quotas on device /dev/ploop12345p1
+Block grace time: 7days; Inode grace time: 7days
+                        Block limits                File limits
+User            used    soft    hard  grace    used  soft  hard  grace
+----------------------------------------------------------------------
+#0        --   20480       0       0      0      2     0     0      0
+#1000     +-   12000   10000   12000 1697000000     5     0  100000      0
+#4294967294 --       0       0       0      0      1    10    20      0
+
+`
+
+func TestParseRepquota(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		typ  string
+		list []quotaEntry
+		err  string
+	}{
+		{
+			name: "report",
+			out:  repquotaOut,
+			typ:  quotaUser,
+			list: []quotaEntry{
+				{Type: quotaUser, ID: 0, BlocksUsed: 20 << 20, InodesUsed: 2},
+				{Type: quotaUser, ID: 1000, BlocksUsed: 12000 << 10, BlocksSoft: 10000 << 10, BlocksHard: 12000 << 10,
+					InodesUsed: 5, InodesHard: 100000},
+				{Type: quotaUser, ID: 4294967294, InodesUsed: 1, InodesSoft: 10, InodesHard: 20},
+			},
+		},
+		{
+			name: "group",
+			out:  "#100 -- 4 0 0 0 1 0 0 0\n",
+			typ:  quotaGroup,
+			list: []quotaEntry{
+				{Type: quotaGroup, ID: 100, BlocksUsed: 4 << 10, InodesUsed: 1},
+			},
+		},
+		{
+			name: "empty",
+			out:  "",
+			typ:  quotaUser,
+		},
+		{
+			name: "names instead of IDs",
+			out:  "root -- 20 0 0 0 2 0 0 0\n",
+			typ:  quotaUser,
+		},
+		{
+			name: "bad ID",
+			out:  "#-1 -- 20 0 0 0 2 0 0 0\n#1 -- 4 0 0 0 1 0 0 0\n",
+			typ:  quotaUser,
+			list: []quotaEntry{
+				{Type: quotaUser, ID: 1, BlocksUsed: 4 << 10, InodesUsed: 1},
+			},
+		},
+		{
+			name: "short line",
+			out:  "#1 -- 20 0 0 0 2 0\n",
+			typ:  quotaUser,
+		},
+		{
+			name: "bad number",
+			out:  "#1 -- 20 0 0 0 2 x 0 0\n",
+			typ:  quotaUser,
+			err:  "Can't parse repquota output",
+		},
+		{
+			name: "human readable sizes",
+			out:  "#1 -- 20M 0 0 0 2 0 0 0\n",
+			typ:  quotaUser,
+			err:  "Can't parse repquota output",
+		},
+	}
+
+	for _, tc := range tests {
+		list, err := parseRepquota(strings.NewReader(tc.out), tc.typ)
+		if tc.err != "" {
+			if err == nil {
+				t.Errorf("%s: no error", tc.name)
+			} else if !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: error %q, expected %q", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(list, tc.list) {
+			t.Errorf("%s: got %+v, expected %+v", tc.name, list, tc.list)
+		}
+	}
+}
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		str  string
+		size bool
+		n    uint64
+		err  bool
+	}{
+		{str: "", size: true, n: 0},
+		{str: "0", size: true, n: 0},
+		{str: "10G", size: true, n: 10 << 30},
+		{str: "512k", size: true, n: 512 << 10},
+		{str: "-1", size: true, err: true},
+		{str: "lots", size: true, err: true},
+		{str: "", n: 0},
+		{str: "100000", n: 100000},
+		{str: "10K", err: true},
+		{str: "-1", err: true},
+	}
+
+	for _, tc := range tests {
+		n, err := parseLimit(tc.str, tc.size)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: no error", tc.str)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", tc.str, err)
+		} else if n != tc.n {
+			t.Errorf("%q: %d, expected %d", tc.str, n, tc.n)
+		}
+	}
+}
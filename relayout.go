@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/kolyshkin/docker-volume-ploop/diskdescriptor"
+	"github.com/kolyshkin/goploop"
+)
+
+/* Changing cluster block size.
+ *
+ * All deltas of an image must have the same cluster block size,
+ * so the whole image is laid out anew, offline. A new image is
+ * created in a temporary directory, and the contents of every
+ * snapshot, from the base up to the top, is copied to it, creating
+ * a snapshot before each level but the base. Once every new level
+ * is verified to be identical to the old one, the new deltas are moved
+ * to the volume directory, and DiskDescriptor.xml is replaced by the
+ * new one, which is an atomic switch to the new image. Old deltas are
+ * then removed.
+ *
+ * Snapshots are preserved, but get new GUIDs.
+ */
+
+// Directory for a new image, inside the volume directory
+const relayoutDir = "relayout.tmp"
+
+// relayoutResult is an outcome of changing volume cluster block size
+type relayoutResult struct {
+	Volume    string
+	OldBlock  uint64 // old cluster block size, in bytes
+	NewBlock  uint64
+	Snapshots map[string]string `json:",omitempty"` // old to new GUIDs
+}
+
+// relayout re-creates an unmounted volume image with a different
+// cluster block size (given as clog, see volumeOptions)
+func (d *ploopDriver) relayout(o *op, name string, clog uint) (_ *relayoutResult, err error) {
+	if err := d.checkBroken(o, name); err != nil {
+		return nil, err
+	}
+	dd := d.dd(name)
+	desc, err := diskdescriptor.Read(dd)
+	if err != nil {
+		return nil, err
+	}
+	chain := desc.Chain()
+	if len(chain) != len(desc.Images) {
+		return nil, fmt.Errorf("Volume %s snapshots are not linear, can't relayout it", name)
+	}
+	r := relayoutResult{Volume: name, OldBlock: desc.BlockSize, NewBlock: (1 << clog) * diskdescriptor.SectorSize}
+	if r.NewBlock == r.OldBlock {
+		return nil, fmt.Errorf("Volume %s already has %d cluster block size", name, r.OldBlock)
+	}
+
+	p, err := ploop.Open(dd)
+	if err != nil {
+		return nil, err
+	}
+	defer p.Close()
+	if m, _ := p.IsMounted(); m {
+		return nil, fmt.Errorf("Volume %s is mounted, can only relayout unmounted volumes", name)
+	}
+
+	mode, _, err := d.imageMode(name, desc)
+	if err != nil {
+		return nil, err
+	}
+	if mode == ploop.Raw {
+		return nil, fmt.Errorf("Volume %s is raw, it has no cluster blocks", name)
+	}
+	if err := d.checkSpace(uint64(filesUsage(desc.Files()))); err != nil {
+		return nil, err
+	}
+
+	defer d.heavyOp(o)()
+	o.log.Infof("Changing cluster block size from %d to %d", r.OldBlock, r.NewBlock)
+
+	j, err := d.journalBegin(o, map[string]string{"old": strings.Join(desc.Files(), "\n")})
+	if err != nil {
+		return nil, err
+	}
+	defer d.journalDone(j, &err)
+
+	tmp := path.Join(d.dir(name), relayoutDir)
+	os.RemoveAll(tmp)
+	if err := os.Mkdir(tmp, 0700); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	// Copy the image, level by level
+	newDD := path.Join(tmp, ddxml)
+	uuid, err := ploop.UUID()
+	if err != nil {
+		return nil, err
+	}
+	cp := ploop.CreateParam{
+		Size:  desc.Size >> 10,
+		Mode:  mode,
+		File:  path.Join(tmp, imagePrefix+"."+uuid),
+		CLog:  clog,
+		Flags: ploop.NoLazy,
+	}
+	if err := ploop.Create(&cp); err != nil {
+		return nil, err
+	}
+	np, err := ploop.Open(newDD)
+	if err != nil {
+		return nil, err
+	}
+	defer np.Close()
+
+	for n := range chain {
+		if n > 0 {
+			// new snapshot for every level but the base,
+			// so the previous level is kept in it
+			if _, err := np.Snapshot(); err != nil {
+				return nil, err
+			}
+		}
+		if err := d.copyLevel(o, p, np, levelGUID(chain, n), r.NewBlock); err != nil {
+			return nil, err
+		}
+		o.setProgress("%d of %d level(s) copied", n+1, len(chain))
+	}
+
+	// Find out the new snapshot GUIDs
+	ndesc, err := diskdescriptor.Read(newDD)
+	if err != nil {
+		return nil, err
+	}
+	nchain := ndesc.Chain()
+	if len(nchain) != len(chain) {
+		return nil, fmt.Errorf("New image has %d level(s), expected %d", len(nchain), len(chain))
+	}
+	r.Snapshots = make(map[string]string)
+	for n := 0; n < len(chain)-1; n++ {
+		r.Snapshots[chain[n].GUID] = nchain[n].GUID
+	}
+
+	// Verify every new level is the same as the old one
+	for n := range chain {
+		if err := d.verifyLevel(o, p, np, levelGUID(chain, n), levelGUID(nchain, n), r.NewBlock); err != nil {
+			return nil, err
+		}
+		o.setProgress("%d of %d level(s) verified", n+1, len(chain))
+	}
+
+	// Move the new deltas in, and switch to the new image
+	var files []string
+	for _, f := range ndesc.Files() {
+		file := path.Join(d.dir(name), path.Base(f))
+		files = append(files, file)
+		j.Args["new"] = strings.Join(files, "\n")
+		if err := d.journalStep(j, "move"); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(f, file); err != nil {
+			return nil, err
+		}
+	}
+	if err := d.switchDD(newDD, dd, tmp); err != nil {
+		for _, f := range files {
+			os.Remove(f)
+		}
+		return nil, err
+	}
+	if err := d.journalStep(j, "switch"); err != nil {
+		return nil, err
+	}
+
+	for _, f := range desc.Files() {
+		if err := os.Remove(f); err != nil {
+			o.log.Warnf("Can't remove old delta: %s", err)
+		}
+	}
+	if err := d.setImageMode(name, mode); err != nil {
+		o.log.Warnf("Can't record image mode: %s", err)
+	}
+
+	return &r, nil
+}
+
+// levelGUID returns a GUID to mount n-th level of an image chain,
+// which is empty for the top one, as it is mounted by default
+func levelGUID(chain []diskdescriptor.Image, n int) string {
+	if n == len(chain)-1 {
+		return ""
+	}
+
+	return chain[n].GUID
+}
+
+// copyLevel copies a snapshot (given by guid, or the top delta
+// if guid is empty) of an image to the top delta of a new image
+func (d *ploopDriver) copyLevel(o *op, src, dst ploop.Ploop, guid string, blockSize uint64) error {
+	srcDev, err := src.Mount(&ploop.MountParam{UUID: guid, Readonly: true})
+	if err != nil {
+		return err
+	}
+	defer ploop.UmountByDevice(srcDev)
+
+	dstDev, err := dst.Mount(&ploop.MountParam{})
+	if err != nil {
+		return err
+	}
+	defer ploop.UmountByDevice(dstDev)
+
+	return copyDev(o, srcDev, dstDev, blockSize)
+}
+
+// verifyLevel compares a level of an image (given by srcGUID)
+// to a level of a new image (given by dstGUID)
+func (d *ploopDriver) verifyLevel(o *op, src, dst ploop.Ploop, srcGUID, dstGUID string, blockSize uint64) error {
+	srcDev, err := src.Mount(&ploop.MountParam{UUID: srcGUID, Readonly: true})
+	if err != nil {
+		return err
+	}
+	defer ploop.UmountByDevice(srcDev)
+
+	dstDev, err := dst.Mount(&ploop.MountParam{UUID: dstGUID, Readonly: true})
+	if err != nil {
+		return err
+	}
+	defer ploop.UmountByDevice(dstDev)
+
+	return verifyDev(o, srcDev, dstDev, blockSize)
+}
+
+// switchDD atomically replaces DiskDescriptor.xml with a new one,
+// fixing up the paths to deltas moved out of the old directory
+func (d *ploopDriver) switchDD(newDD, dd, old string) error {
+	b, err := ioutil.ReadFile(newDD)
+	if err != nil {
+		return err
+	}
+	b = bytes.Replace(b, []byte(old+"/"), nil, -1)
+	if _, err := diskdescriptor.Parse(b, path.Dir(dd)); err != nil {
+		return fmt.Errorf("Bad new %s: %s", ddxml, err)
+	}
+
+	file := dd + ".tmp"
+	if err := ioutil.WriteFile(file, b, 0600); err != nil {
+		os.Remove(file)
+		return err
+	}
+	if err := os.Rename(file, dd); err != nil {
+		os.Remove(file)
+		return err
+	}
+
+	return syncDir(path.Dir(dd))
+}
+
+// recoverRelayout cleans up after an unfinished cluster block size
+// change, removing either the new or the old deltas, depending on
+// which ones DiskDescriptor.xml refers to
+func recoverRelayout(d *ploopDriver, i *intent) error {
+	tmp := path.Join(d.dir(i.Volume), relayoutDir)
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+
+	return removeUnused(d, i.Volume, strings.Split(i.Args["old"]+"\n"+i.Args["new"], "\n"))
+}
+
+// removeUnused removes the given deltas of a volume, unless they are
+// referred to by its DiskDescriptor.xml
+func removeUnused(d *ploopDriver, name string, files []string) error {
+	desc, err := diskdescriptor.Read(d.dd(name))
+	if err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	for _, f := range desc.Files() {
+		used[f] = true
+	}
+
+	for _, f := range files {
+		if f == "" || used[f] {
+			continue
+		}
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// adminRelayout changes volume cluster block size
+func (d *ploopDriver) adminRelayout(r *http.Request) (interface{}, error) {
+	var res *relayoutResult
+	var v volumeOptions
+
+	name := r.FormValue("volume")
+	if name == "" {
+		return nil, fmt.Errorf("Volume name is required")
+	}
+	if err := d.findVol(name); err != nil {
+		return nil, err
+	}
+	if err := v.setCLog(r.FormValue("clog")); err != nil {
+		return nil, err
+	}
+	if v.clog < 6 || v.clog > 15 {
+		return nil, fmt.Errorf("Invalid clog %d (should be from 6 to 15)", v.clog)
+	}
+
+	o := newOp("relayout", name)
+	err := d.runTimeout(o, map[string]string{"clog": strconv.Itoa(int(v.clog))}, 0, func() (err error) {
+		res, err = d.relayout(o, name, v.clog)
+		return err
+	}, nil)
+
+	return res, err
+}
+
+func cmdRelayout(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("Usage: relayout VOLUME CLOG")
+	}
+
+	q := url.Values{}
+	q.Set("volume", args[0])
+	q.Set("clog", args[1])
+
+	var r relayoutResult
+	if err := adminCall("POST", "/relayout?"+q.Encode(), nil, &r); err != nil {
+		return err
+	}
+
+	return printJSON(r)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/kolyshkin/goploop"
+)
+
+/* Volume rename.
+ *
+ * Docker has no notion of renaming a volume, so it's done via the
+ * admin API, for unmounted volumes only. Volume directory is renamed,
+ * which is atomic, then DiskDescriptor.xml is fixed up in case it
+ * refers to deltas by absolute paths, and the old mount point is
+ * removed (a new one is created on mount).
+ */
+
+// renameResult is an outcome of a volume rename
+type renameResult struct {
+	Volume  string
+	NewName string
+}
+
+// rename renames an unmounted volume
+func (d *ploopDriver) rename(o *op, name, newName string) (_ *renameResult, err error) {
+	if err := d.checkBroken(o, name); err != nil {
+		return nil, err
+	}
+	if err := checkVolName(newName); err != nil {
+		return nil, err
+	}
+
+	// Check the new name before locking it, so two renames
+	// of volumes into each other's names can't deadlock
+	if _, err := os.Stat(d.dir(newName)); !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Volume %s already exists", newName)
+	}
+	d.locks.lock(newName)
+	defer d.locks.unlock(newName)
+	if _, err := os.Stat(d.dir(newName)); !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Volume %s already exists", newName)
+	}
+
+	p, err := ploop.Open(d.dd(name))
+	if err != nil {
+		return nil, err
+	}
+	m, _ := p.IsMounted()
+	p.Close()
+	if m || d.hasConsumers(name) {
+		return nil, fmt.Errorf("Volume %s is mounted, can only rename unmounted volumes", name)
+	}
+
+	o.log.Infof("Renaming volume to %s", newName)
+	j, err := d.journalBegin(o, map[string]string{"to": newName})
+	if err != nil {
+		return nil, err
+	}
+	defer d.journalDone(j, &err)
+
+	if err := os.Rename(d.dir(name), d.dir(newName)); err != nil {
+		return nil, err
+	}
+	if err := d.journalStep(j, "rename"); err != nil {
+		return nil, err
+	}
+	if err := d.renameFixup(name, newName); err != nil {
+		return nil, err
+	}
+
+	return &renameResult{Volume: name, NewName: newName}, nil
+}
+
+// renameFixup finishes a volume rename once its directory is renamed
+func (d *ploopDriver) renameFixup(name, newName string) error {
+	dd := d.dd(newName)
+	if err := d.switchDD(dd, dd, d.dir(name)); err != nil {
+		return err
+	}
+	if err := os.Remove(d.mnt(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// recoverRename completes an unfinished volume rename,
+// if the volume directory was renamed already
+func recoverRename(d *ploopDriver, i *intent) error {
+	newName := i.Args["to"]
+	if newName == "" {
+		return nil
+	}
+	if _, err := os.Stat(d.dir(newName)); err != nil {
+		// not renamed
+		return nil
+	}
+	if _, err := os.Stat(d.dir(i.Volume)); err == nil {
+		// both exist, so the new one is not ours
+		return nil
+	}
+
+	return d.renameFixup(i.Volume, newName)
+}
+
+// adminRename renames a volume
+func (d *ploopDriver) adminRename(r *http.Request) (interface{}, error) {
+	var res *renameResult
+
+	name := r.FormValue("volume")
+	if name == "" {
+		return nil, fmt.Errorf("Volume name is required")
+	}
+	if err := d.findVol(name); err != nil {
+		return nil, err
+	}
+	newName := r.FormValue("name")
+
+	o := newOp("rename", name)
+	err := d.runTimeout(o, map[string]string{"name": newName}, 0, func() (err error) {
+		res, err = d.rename(o, name, newName)
+		return err
+	}, nil)
+
+	return res, err
+}
+
+func cmdRename(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("Usage: rename VOLUME NEW-NAME")
+	}
+
+	q := url.Values{}
+	q.Set("volume", args[0])
+	q.Set("name", args[1])
+
+	var r renameResult
+	if err := adminCall("POST", "/rename?"+q.Encode(), nil, &r); err != nil {
+		return err
+	}
+
+	return printJSON(r)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"os"
+	"path"
+	"strings"
+)
+
+/* SELinux labelling.
+ *
+ * On SELinux enabled hosts, the inner filesystem is mounted with
+ * context= mount option, so all its files get a label containers
+ * are allowed to use, with no need to relabel anything. The label
+ * is either shared (can be used by any container, like :z bind
+ * mount option does), or private, with random MCS categories (like
+ * :Z does), which is generated once on volume creation.
+ */
+
+// SELinux labelling modes
+const (
+	selinuxNone    = "none"
+	selinuxShared  = "shared"
+	selinuxPrivate = "private"
+)
+
+const (
+	selinuxFS     = "/sys/fs/selinux"
+	selinuxConfig = "/etc/selinux/config"
+	// label to use if there's none in policy lxc_contexts
+	selinuxDefaultLabel = "system_u:object_r:svirt_sandbox_file_t:s0"
+	// number of MCS categories
+	selinuxCategories = 1024
+)
+
+// selinuxEnabled checks if SELinux is enabled on the host
+func selinuxEnabled() bool {
+	_, err := os.Stat(path.Join(selinuxFS, "enforce"))
+	return err == nil
+}
+
+// checkSELinuxMode checks if a labelling mode is valid
+func checkSELinuxMode(mode string) error {
+	switch mode {
+	case selinuxNone, selinuxShared, selinuxPrivate:
+		return nil
+	}
+
+	return fmt.Errorf("Can't parse selinux %s (use shared, private or none)", mode)
+}
+
+// readKeyValues reads a file of key=value lines, skipping comments
+func readKeyValues(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	kv := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || l[0] == '#' {
+			continue
+		}
+		p := strings.SplitN(l, "=", 2)
+		if len(p) != 2 {
+			continue
+		}
+		kv[strings.TrimSpace(p[0])] = strings.Trim(strings.TrimSpace(p[1]), `"`)
+	}
+
+	return kv, s.Err()
+}
+
+// selinuxFileLabel returns a container file label from the policy,
+// the same one as used by container runtimes
+func selinuxFileLabel() string {
+	conf, err := readKeyValues(selinuxConfig)
+	if err != nil || conf["SELINUXTYPE"] == "" {
+		return selinuxDefaultLabel
+	}
+	ctx, err := readKeyValues(path.Join(path.Dir(selinuxConfig), conf["SELINUXTYPE"], "contexts", "lxc_contexts"))
+	if err != nil || ctx["file"] == "" {
+		return selinuxDefaultLabel
+	}
+
+	return ctx["file"]
+}
+
+// selinuxLabel returns a label for a volume. For private mode,
+// a random pair of MCS categories is used.
+func selinuxLabel(mode string) (string, error) {
+	label := selinuxFileLabel()
+	if mode != selinuxPrivate {
+		return label, nil
+	}
+
+	// user:role:type:level, replace the level
+	p := strings.SplitN(label, ":", 4)
+	if len(p) < 3 {
+		return "", fmt.Errorf("Can't parse SELinux label %s", label)
+	}
+	var c [2]int64
+	for c[0] == c[1] {
+		for i := range c {
+			n, err := rand.Int(rand.Reader, big.NewInt(selinuxCategories))
+			if err != nil {
+				return "", err
+			}
+			c[i] = n.Int64()
+		}
+	}
+	if c[0] > c[1] {
+		c[0], c[1] = c[1], c[0]
+	}
+
+	return fmt.Sprintf("%s:%s:%s:s0:c%d,c%d", p[0], p[1], p[2], c[0], c[1]), nil
+}
+
+// selinuxMountData returns a mount option for a label
+func selinuxMountData(label string) string {
+	// the label might contain commas, so quote it
+	return `context="` + label + `"`
+}
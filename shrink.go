@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/docker/go-units"
+	"github.com/kolyshkin/docker-volume-ploop/diskdescriptor"
+	"github.com/kolyshkin/goploop"
+)
+
+// Free space to leave in a shrunk filesystem: a percentage
+// of the used space, but no less than the minimum
+const (
+	shrinkMargin  = 10 // percent
+	shrinkMinFree = 256 << 20
+)
+
+// shrinkResult is an outcome of volume shrink (or a dry run)
+type shrinkResult struct {
+	Volume  string
+	DryRun  bool
+	Size    uint64 // size before shrink, in bytes
+	Used    uint64 // used by the filesystem
+	MinSize uint64 // minimum size the volume can be shrunk to
+	NewSize uint64 `json:",omitempty"`
+}
+
+// roundUp rounds n up to a multiple of r
+func roundUp(n, r uint64) uint64 {
+	return (n + r - 1) / r * r
+}
+
+// shrink shrinks an unmounted volume to a given size (in bytes),
+// or, for a dry run, finds out the minimum size possible
+func (d *ploopDriver) shrink(o *op, name string, size uint64, dryRun bool) (*shrinkResult, error) {
+	if err := d.checkBroken(o, name); err != nil {
+		return nil, err
+	}
+	// xfs can't be shrunk
+	if err := d.checkExt4(name, "shrink"); err != nil {
+		return nil, err
+	}
+	if err := d.checkEncrypted(name, "shrink"); err != nil {
+		return nil, err
+	}
+	desc, err := diskdescriptor.Read(d.dd(name))
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := ploop.Open(d.dd(name))
+	if err != nil {
+		return nil, err
+	}
+	defer p.Close()
+
+	if m, _ := p.IsMounted(); m {
+		return nil, fmt.Errorf("Volume %s is mounted, can only shrink unmounted volumes", name)
+	}
+
+	fs, err := ploop.FSInfo(d.dd(name))
+	if err != nil {
+		return nil, fmt.Errorf("Can't get filesystem usage: %s", err)
+	}
+
+	r := shrinkResult{Volume: name, DryRun: dryRun, Size: desc.Size}
+	r.Used = (fs.Blocks - fs.BlocksFree) * fs.BlockSize
+	free := r.Used * shrinkMargin / 100
+	if free < shrinkMinFree {
+		free = shrinkMinFree
+	}
+	r.MinSize = roundUp(r.Used+free, desc.BlockSize)
+	// The number of inodes is proportional to filesystem size,
+	// so make sure there'll be enough of them, too
+	if fs.Inodes > 0 {
+		used := fs.Inodes - fs.InodesFree
+		need := used + used*shrinkMargin/100
+		if min := roundUp(desc.Size/fs.Inodes*need, desc.BlockSize); min > r.MinSize {
+			r.MinSize = min
+		}
+	}
+	if r.MinSize > r.Size {
+		r.MinSize = r.Size
+	}
+
+	if dryRun {
+		return &r, nil
+	}
+
+	size = roundUp(size, desc.BlockSize)
+	if size >= r.Size {
+		return nil, fmt.Errorf("New size %s is not smaller than current %s",
+			units.BytesSize(float64(size)), units.BytesSize(float64(r.Size)))
+	}
+	if size < r.MinSize {
+		return nil, fmt.Errorf("New size %s is unsafe, the minimum is %s (%s used)",
+			units.BytesSize(float64(size)), units.BytesSize(float64(r.MinSize)),
+			units.BytesSize(float64(r.Used)))
+	}
+
+	defer d.heavyOp(o)()
+
+	o.log.Infof("Shrinking volume from %s to %s",
+		units.BytesSize(float64(r.Size)), units.BytesSize(float64(size)))
+	// offline resize shrinks the filesystem first, then the image
+	if err := p.Resize(size>>10, true); err != nil {
+		return nil, err
+	}
+	r.NewSize = size
+
+	return &r, nil
+}
+
+// adminShrink shrinks a volume
+func (d *ploopDriver) adminShrink(r *http.Request) (interface{}, error) {
+	var res *shrinkResult
+	var size int64
+
+	name := r.FormValue("volume")
+	if name == "" {
+		return nil, fmt.Errorf("Volume name is required")
+	}
+	if err := d.findVol(name); err != nil {
+		return nil, err
+	}
+	dryRun := r.FormValue("dry-run") != ""
+	if !dryRun {
+		var err error
+		size, err = units.RAMInBytes(r.FormValue("size"))
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("Can't parse size %s", r.FormValue("size"))
+		}
+	}
+
+	opName := "shrink"
+	opts := map[string]string{"size": r.FormValue("size")}
+	if dryRun {
+		opName = "shrink-dry-run"
+		opts = nil
+	}
+	o := newOp(opName, name)
+	err := d.runTimeout(o, opts, 0, func() (err error) {
+		res, err = d.shrink(o, name, uint64(size), dryRun)
+		return err
+	}, nil)
+
+	return res, err
+}
+
+func cmdShrink(args []string) error {
+	fs := flag.NewFlagSet("shrink", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Only report the minimum possible size")
+	fs.Parse(args)
+	if fs.NArg() != 2 && !(*dryRun && fs.NArg() == 1) {
+		return fmt.Errorf("Usage: shrink VOLUME SIZE, or shrink -dry-run VOLUME")
+	}
+
+	q := url.Values{}
+	q.Set("volume", fs.Arg(0))
+	if *dryRun {
+		q.Set("dry-run", "1")
+	} else {
+		q.Set("size", fs.Arg(1))
+	}
+
+	var r shrinkResult
+	if err := adminCall("POST", "/shrink?"+q.Encode(), nil, &r); err != nil {
+		return err
+	}
+
+	return printJSON(r)
+}
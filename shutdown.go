@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/coreos/go-systemd/activation"
+	"github.com/coreos/go-systemd/util"
+	"github.com/docker/go-connections/sockets"
+)
+
+// What to do with mounted volumes on shutdown
+const (
+	// leave all mounts as they are, for the next instance to adopt
+	onShutdownKeep = "keep"
+	// unmount volumes which are not used by any container
+	onShutdownUnmount = "unmount"
+)
+
+const (
+	pluginName    = "ploop"
+	pluginSockDir = "/run/docker/plugins"
+)
+
+// pluginListener returns a listener for Docker plugin API requests,
+// either passed by systemd (socket activation), or a newly created
+// unix socket. In the latter case, the socket path is returned,
+// so it can be removed on exit.
+func pluginListener(name, group string) (net.Listener, string, error) {
+	if util.IsRunningSystemd() {
+		files := activation.Files(false)
+		if len(files) > 1 {
+			return nil, "", fmt.Errorf("Expected only one socket from systemd, got %d", len(files))
+		}
+		if len(files) == 1 {
+			l, err := net.FileListener(files[0])
+			return l, "", err
+		}
+	}
+
+	if err := os.MkdirAll(pluginSockDir, 0755); err != nil {
+		return nil, "", err
+	}
+	sock := filepath.Join(pluginSockDir, name+".sock")
+	l, err := sockets.NewUnixSocket(sock, group)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return l, sock, nil
+}
+
+// admit checks whether an operation o can be started now, and if yes,
+// accounts it as running. Once it's finished, d.running.Done()
+// must be called.
+func (d *ploopDriver) admit(o *op) error {
+	d.stateM.Lock()
+	defer d.stateM.Unlock()
+
+	if d.stopping {
+		return fmt.Errorf("Plugin is shutting down")
+	}
+	if d.draining && (o.name == "create" || o.name == "mount") {
+		return fmt.Errorf("Plugin is in drain mode, new volumes and mounts are not accepted")
+	}
+	d.running.Add(1)
+
+	return nil
+}
+
+// setDrain enables or disables the drain mode
+func (d *ploopDriver) setDrain(on bool) {
+	d.stateM.Lock()
+	d.draining = on
+	d.stateM.Unlock()
+
+	logrus.Infof("Drain mode: %v", on)
+}
+
+// addConsumer records that a volume is mounted for a container with mount ID id
+func (d *ploopDriver) addConsumer(name, id string) {
+	d.mountsM.Lock()
+	defer d.mountsM.Unlock()
+
+	m, ok := d.mounts[name]
+	if !ok {
+		m = &mount{ids: make(map[string]bool)}
+		d.mounts[name] = m
+	}
+	m.ids[id] = true
+	d.saveConsumers(name, m)
+}
+
+// delConsumer forgets about a container with mount ID id using a volume,
+// and returns whether the volume is no longer used by any container.
+// A volume adopted with unknown consumers might still be used by some,
+// so it is kept mounted until released by an admin.
+func (d *ploopDriver) delConsumer(name, id string) bool {
+	d.mountsM.Lock()
+	defer d.mountsM.Unlock()
+
+	m, ok := d.mounts[name]
+	if !ok {
+		return true
+	}
+	delete(m.ids, id)
+	d.saveConsumers(name, m)
+
+	return !m.adopted && len(m.ids) == 0
+}
+
+// isMounted checks whether a volume is mounted by us (or was adopted)
+func (d *ploopDriver) isMounted(name string) bool {
+	d.mountsM.RLock()
+	defer d.mountsM.RUnlock()
+
+	_, ok := d.mounts[name]
+	return ok
+}
+
+// delMount forgets about a volume which is no longer mounted
+func (d *ploopDriver) delMount(name string) {
+	d.mountsM.Lock()
+	delete(d.mounts, name)
+	d.mountsM.Unlock()
+}
+
+// A line in a dirty mark saying there are unknown consumers
+const unknownConsumers = "?"
+
+// saveConsumers writes the mount IDs of containers using a volume to
+// its dirty mark, so that the next plugin instance knows them.
+// Failing that is not fatal, so it's only logged.
+func (d *ploopDriver) saveConsumers(name string, m *mount) {
+	var b bytes.Buffer
+	if m.adopted {
+		fmt.Fprintln(&b, unknownConsumers)
+	}
+	for id := range m.ids {
+		fmt.Fprintln(&b, id)
+	}
+	if err := ioutil.WriteFile(d.dirtyMark(name), b.Bytes(), 0600); err != nil {
+		logrus.Warnf("Can't save volume %s consumers: %s", name, err)
+	}
+}
+
+// loadConsumers reads the mount IDs saved by saveConsumers,
+// and whether there are unknown consumers, too
+func (d *ploopDriver) loadConsumers(name string) (map[string]bool, bool) {
+	ids := make(map[string]bool)
+	unknown := false
+	b, err := ioutil.ReadFile(d.dirtyMark(name))
+	if err != nil {
+		return ids, false
+	}
+	for _, id := range strings.Fields(string(b)) {
+		if id == unknownConsumers {
+			unknown = true
+			continue
+		}
+		ids[id] = true
+	}
+
+	return ids, unknown
+}
+
+// hasConsumers checks whether a mounted volume is (or might be)
+// used by a container
+func (d *ploopDriver) hasConsumers(name string) bool {
+	d.mountsM.RLock()
+	defer d.mountsM.RUnlock()
+
+	m, ok := d.mounts[name]
+	return ok && (m.adopted || len(m.ids) > 0)
+}
+
+// mountedVolumes returns the names of volumes currently mounted
+func (d *ploopDriver) mountedVolumes() ([]string, error) {
+	mnts, err := getMountPoints(d.mnt(""))
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(mnts))
+	for _, m := range mnts {
+		names = append(names, path.Base(m))
+	}
+
+	return names, nil
+}
+
+// adoptMounts finds volumes left mounted by a previous plugin instance,
+// along with containers using them. If those are not known, we assume
+// the volumes are used.
+func (d *ploopDriver) adoptMounts() {
+	names, err := d.mountedVolumes()
+	if err != nil {
+		logrus.Errorf("Can't get mounted volumes: %s", err)
+		return
+	}
+
+	d.mountsM.Lock()
+	for _, name := range names {
+		ids, unknown := d.loadConsumers(name)
+		d.mounts[name] = &mount{adopted: unknown || len(ids) == 0, ids: ids}
+	}
+	d.mountsM.Unlock()
+
+	if len(names) > 0 {
+		logrus.Infof("Adopted %d mounted volume(s)", len(names))
+	}
+}
+
+// stop makes the driver reject all new operations
+func (d *ploopDriver) stop() {
+	d.stateM.Lock()
+	d.stopping = true
+	d.stateM.Unlock()
+}
+
+func (d *ploopDriver) isStopping() bool {
+	d.stateM.Lock()
+	defer d.stateM.Unlock()
+
+	return d.stopping
+}
+
+// shutdown waits for the operations in progress to finish,
+// and deals with mounted volumes according to policy
+func (d *ploopDriver) shutdown(policy string, wait time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		d.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(wait):
+		logrus.Warnf("Operations still running after %s, exiting anyway", wait)
+		return
+	}
+
+	if policy != onShutdownUnmount {
+		return
+	}
+
+	names, err := d.mountedVolumes()
+	if err != nil {
+		logrus.Errorf("Can't get mounted volumes: %s", err)
+		return
+	}
+	for _, name := range names {
+		if d.hasConsumers(name) {
+			continue
+		}
+		o := newOp("unmount", name)
+		o.log.Infof("Unmounting unused volume on shutdown")
+		err := d.unmount(o, name)
+		o.finish(nil, err)
+	}
+}
+
+// handleSignals waits for a termination signal, and once it's received,
+// stops serving plugin requests (by closing l) and shuts the driver down.
+// Once done, it closes the returned channel.
+func (d *ploopDriver) handleSignals(l net.Listener, policy string, wait time.Duration) <-chan struct{} {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	done := make(chan struct{})
+
+	go func() {
+		sig := <-sigs
+		logrus.Infof("Got %s, shutting down", sig)
+		d.stop()
+		sdNotify("STOPPING=1")
+		l.Close()
+		d.shutdown(policy, wait)
+		close(done)
+	}()
+
+	return done
+}
+
+// releaseAdopted unmounts a volume adopted with unknown consumers,
+// once an admin knows it's no longer used by any container
+func (d *ploopDriver) releaseAdopted(o *op, name string) error {
+	d.mountsM.RLock()
+	m, ok := d.mounts[name]
+	adopted, used := ok && m.adopted, ok && len(m.ids) > 0
+	d.mountsM.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("Volume %s is not mounted", name)
+	}
+	if !adopted {
+		return fmt.Errorf("Volume %s has no unknown users, it's unmounted once its containers are gone", name)
+	}
+	if used {
+		return fmt.Errorf("Volume %s is still used by known containers", name)
+	}
+	if err := d.unmount(o, name); err != nil {
+		return err
+	}
+	d.delMount(name)
+
+	return nil
+}
+
+// adminRelease unmounts a volume adopted with unknown consumers
+func (d *ploopDriver) adminRelease(r *http.Request) (interface{}, error) {
+	name := r.FormValue("volume")
+	if name == "" {
+		return nil, fmt.Errorf("Volume name is required")
+	}
+	if err := d.findVol(name); err != nil {
+		return nil, err
+	}
+	o := newOp("release", name)
+	err := d.runAdmin(o, func() error {
+		return d.releaseAdopted(o, name)
+	})
+
+	return struct{}{}, err
+}
+
+func cmdRelease(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: release VOLUME")
+	}
+
+	var out struct{}
+	return adminCall("POST", "/release?volume="+url.QueryEscape(args[0]), nil, &out)
+}
+
+// adminDrain enables or disables the drain mode
+func (d *ploopDriver) adminDrain(r *http.Request) (interface{}, error) {
+	switch r.FormValue("mode") {
+	case "", "on":
+		d.setDrain(true)
+	case "off":
+		d.setDrain(false)
+	default:
+		return nil, fmt.Errorf("Invalid drain mode %s (use on or off)", r.FormValue("mode"))
+	}
+
+	return struct{}{}, nil
+}
+
+func cmdDrain(args []string) error {
+	mode := "on"
+	if len(args) > 1 {
+		return fmt.Errorf("Too many arguments")
+	}
+	if len(args) == 1 {
+		mode = args[0]
+	}
+
+	var out struct{}
+	return adminCall("POST", "/drain?mode="+url.QueryEscape(mode), nil, &out)
+}
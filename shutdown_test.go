@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestConsumers(t *testing.T) {
+	home, err := ioutil.TempDir("", "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	d := &ploopDriver{home: home, mounts: make(map[string]*mount)}
+	if err := os.MkdirAll(d.dir("vol"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	d.addConsumer("vol", "a")
+	d.addConsumer("vol", "b")
+	if d.delConsumer("vol", "a") {
+		t.Error("volume is unused while still having a consumer")
+	}
+	if !d.delConsumer("vol", "b") {
+		t.Error("volume is used after all consumers are gone")
+	}
+
+	// adopted with unknown consumers, which are saved
+	d.mounts["vol"] = &mount{adopted: true, ids: make(map[string]bool)}
+	d.addConsumer("vol", "c")
+	ids, unknown := d.loadConsumers("vol")
+	if !unknown || len(ids) != 1 || !ids["c"] {
+		t.Errorf("loaded %v, unknown %v", ids, unknown)
+	}
+	if d.delConsumer("vol", "c") {
+		t.Error("adopted volume is unused after its known consumers are gone")
+	}
+	if !d.hasConsumers("vol") {
+		t.Error("adopted volume has no consumers")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Interval to update the status if there's no watchdog
+const healthInterval = time.Minute
+
+// sdNotify sends a state notification to systemd (see sd_notify(3)).
+// It does nothing if the plugin is not run by systemd as Type=notify.
+func sdNotify(state string) error {
+	sock := os.Getenv("NOTIFY_SOCKET")
+	if sock == "" {
+		return nil
+	}
+	if strings.HasPrefix(sock, "@") {
+		// abstract namespace socket
+		sock = "\x00" + sock[1:]
+	}
+
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	_, err = c.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the interval systemd expects to be
+// pinged at, or 0 if the watchdog is not enabled
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseUint(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec == 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		// not for us
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// withTimeout runs fn, waiting for it for no longer than t
+func withTimeout(t time.Duration, fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(t):
+		return fmt.Errorf("timed out after %s", t)
+	}
+}
+
+// status returns a short plugin status, like number of volumes
+func (d *ploopDriver) status() (string, error) {
+	vols, err := d.list()
+	if err != nil {
+		return "", err
+	}
+	mnts, err := d.mountedVolumes()
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%d volume(s), %d mounted", len(vols), len(mnts)), nil
+}
+
+// healthCheck checks that home is accessible, and the plugin
+// responds to Docker requests on sock. If everything is fine,
+// a status string is returned.
+func (d *ploopDriver) healthCheck(sock string, t time.Duration) (string, error) {
+	var status string
+
+	err := withTimeout(t, func() (err error) {
+		status, err = d.status()
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("home %s is not accessible: %s", d.home, err)
+	}
+
+	err = withTimeout(t, func() error {
+		c := http.Client{
+			Transport: &http.Transport{
+				Dial: func(_, _ string) (net.Conn, error) {
+					return net.Dial("unix", sock)
+				},
+			},
+		}
+		resp, err := c.Post("http://plugin/VolumeDriver.List", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s", resp.Status)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("plugin does not respond: %s", err)
+	}
+
+	return status, nil
+}
+
+// healthLoop periodically checks the plugin health, updating
+// the status shown by systemd, and pinging the systemd watchdog
+// if everything is fine
+func (d *ploopDriver) healthLoop(sock string) {
+	wd := watchdogInterval()
+	interval := healthInterval
+	if wd != 0 {
+		// ping twice as often as required
+		interval = wd / 2
+	}
+
+	for {
+		time.Sleep(interval)
+		if d.isStopping() {
+			return
+		}
+
+		status, err := d.healthCheck(sock, interval/2)
+		if err != nil {
+			logrus.Errorf("Health check failed: %s", err)
+			sdNotify("STATUS=Unhealthy: " + err.Error())
+			continue
+		}
+
+		state := "STATUS=" + status
+		if wd != 0 {
+			state += "\nWATCHDOG=1"
+		}
+		sdNotify(state)
+	}
+}
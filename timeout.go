@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// run performs an operation o by calling fn with the volume locked,
+// and waits for it to finish, but not longer than the operation timeout.
+//
+// If the timeout expires, an error is returned, while fn keeps running
+// in background. Once it finishes, the outcome is logged and audited
+// as usual, and, if fn succeeded, rollback (if not nil) is called to
+// undo what Docker thinks has failed.
+func (d *ploopDriver) run(o *op, opts map[string]string, fn func() error, rollback func()) error {
+	return d.runTimeout(o, opts, d.dopts.timeout, fn, rollback)
+}
+
+// runAdmin is like run, but with no timeout, for admin operations
+// (which might take long, and are not blocking Docker)
+func (d *ploopDriver) runAdmin(o *op, fn func() error) error {
+	return d.runTimeout(o, nil, 0, fn, nil)
+}
+
+// runTimeout is like run, but with an explicit timeout (0: no timeout)
+func (d *ploopDriver) runTimeout(o *op, opts map[string]string, timeout time.Duration, fn func() error, rollback func()) error {
+	if err := d.admit(o); err != nil {
+		o.finish(opts, err)
+		return err
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		defer d.running.Done()
+		if o.vol != "" && !o.ownLock {
+			defer d.lockVol(o)()
+		}
+		err := fn()
+		o.finish(opts, err)
+
+		if o.isTimedOut() {
+			if err != nil {
+				o.log.Warnf("Operation has failed after timing out")
+			} else if rollback != nil {
+				o.log.Warnf("Operation has finished after timing out, rolling back")
+				rollback()
+			} else {
+				o.log.Warnf("Operation has finished after timing out")
+			}
+		}
+		done <- err
+	}()
+
+	if timeout == 0 {
+		return <-done
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-t.C:
+		o.setTimedOut()
+		metrics.Add(metricTimeouts, 1)
+		o.log.Errorf("Timed out after %s, continuing in background", timeout)
+		return fmt.Errorf("Operation %s timed out after %s", o, timeout)
+	}
+}
+
+func (o *op) setTimedOut() {
+	atomic.StoreInt32(&o.timedOut, 1)
+}
+
+func (o *op) isTimedOut() bool {
+	return atomic.LoadInt32(&o.timedOut) != 0
+}
+
+// opInfo describes an operation in progress, for the admin API
+type opInfo struct {
+	Op       string
+	Volume   string `json:",omitempty"`
+	MountID  string `json:",omitempty"`
+	Started  time.Time
+	Elapsed  string
+	TimedOut bool
+	Progress string `json:",omitempty"`
+}
+
+// adminOps lists the operations in progress
+func (d *ploopDriver) adminOps(r *http.Request) (interface{}, error) {
+	list := inFlight()
+	info := make([]opInfo, len(list))
+	for i, o := range list {
+		info[i] = opInfo{
+			Op:       o.name,
+			Volume:   o.vol,
+			MountID:  o.id,
+			Started:  o.start,
+			Elapsed:  time.Since(o.start).String(),
+			TimedOut: o.isTimedOut(),
+			Progress: o.getProgress(),
+		}
+	}
+
+	return info, nil
+}
+
+func cmdOps(args []string) error {
+	var info []opInfo
+	if err := adminCall("GET", "/ops", nil, &info); err != nil {
+		return err
+	}
+
+	return printJSON(info)
+}
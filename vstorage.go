@@ -4,49 +4,12 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"os/exec"
-	"strings"
-	"syscall"
 
 	"github.com/Sirupsen/logrus"
 )
 
-// Err is a structure used to return errors from vstorage execution
-type Err struct {
-	c int
-	s string
-}
-
-// Error returns a string representation of a vstorage error
-func (e *Err) Error() string {
-	return fmt.Sprintf("vstorage error %d: %s", e.c, e.s)
-}
-
 func vstorageRunCmd(stdout io.Writer, args ...string) error {
-	var stderr bytes.Buffer
-	cmd := exec.Command("vstorage", args...)
-	cmd.Stdout = stdout
-	cmd.Stderr = &stderr
-
-	logrus.Debugf("Run: %s\n", strings.Join([]string{cmd.Path, strings.Join(cmd.Args[1:], " ")}, " "))
-
-	err := cmd.Run()
-	if err == nil {
-		return nil
-	}
-
-	// Command returned an error, get the first line of stderr
-	errStr, _ := stderr.ReadString('\n')
-
-	// Get the exit code (Unix-specific)
-	if exiterr, ok := err.(*exec.ExitError); ok {
-		if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-			errCode := status.ExitStatus()
-			return &Err{c: errCode, s: errStr}
-		}
-	}
-	// unknown exit code
-	return &Err{c: -1, s: errStr}
+	return runCmd(stdout, "vstorage", args...)
 }
 
 func vstorage(args ...string) error {
@@ -79,7 +42,7 @@ func vstorageSetTier(path string, tier int8) error {
 func isOnVstorage(path string) bool {
 	fs, err := GetFilesystemType(path)
 	if err != nil {
-		logrus.Errorf("Can't figure %s fs: %v", err)
+		logrus.Errorf("Can't figure %s fs: %v", path, err)
 		return false
 	}
 